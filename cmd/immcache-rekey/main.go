@@ -0,0 +1,56 @@
+// Command immcache-rekey re-signs offline the files of a cache directory after
+// a rotation of its secret. The secrets are given hex-encoded, through the
+// environment to keep them out of the process list:
+//
+//	IMMCACHE_SECRET=<hex> IMMCACHE_PREVIOUS_SECRETS=<hex>,<hex> immcache-rekey -dir /var/cache/assets
+//
+// An empty IMMCACHE_SECRET re-signs the files with unkeyed sums, and an empty
+// item of IMMCACHE_PREVIOUS_SECRETS stands for the unkeyed sums.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jinroh/immcache"
+)
+
+func main() {
+	dir := flag.String("dir", "", "base directory of the cache")
+	flag.Parse()
+	if *dir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := immcache.DiskCacheOptions{BasePath: *dir}
+	secret, err := hex.DecodeString(os.Getenv("IMMCACHE_SECRET"))
+	exitOnErr(err)
+	if len(secret) > 0 {
+		opts.Secret = secret
+		opts.HashMode = immcache.HashKeyedConfigured
+	} else {
+		opts.HashMode = immcache.HashUnkeyed
+	}
+	if previous := os.Getenv("IMMCACHE_PREVIOUS_SECRETS"); previous != "" {
+		for _, s := range strings.Split(previous, ",") {
+			prev, err := hex.DecodeString(strings.TrimSpace(s))
+			exitOnErr(err)
+			opts.PreviousSecrets = append(opts.PreviousSecrets, prev)
+		}
+	}
+	if len(opts.PreviousSecrets) == 0 {
+		exitOnErr(fmt.Errorf("no previous secrets given"))
+	}
+	exitOnErr(immcache.Rekey(opts))
+}
+
+func exitOnErr(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "exit: %s\n", err)
+		os.Exit(1)
+	}
+}
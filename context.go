@@ -0,0 +1,103 @@
+package immcache
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// contextLoader turns a Loader into a ContextLoader ignoring the context.
+type contextLoader struct {
+	l Loader
+}
+
+func (l contextLoader) LoadContext(_ context.Context, key string) (int64, io.ReadCloser, error) {
+	return l.l.Load(key)
+}
+
+// detachedContext carries the values of its parent context without its
+// deadline and cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) { return }
+func (detachedContext) Done() <-chan struct{}                   { return nil }
+func (detachedContext) Err() error                              { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+func newLoadCall(ctx context.Context) *loadCall {
+	lctx, cancel := context.WithCancel(detachedContext{ctx})
+	return &loadCall{
+		done:   make(chan struct{}),
+		ready:  make(chan struct{}),
+		ctx:    lctx,
+		cancel: cancel,
+		refs:   1,
+	}
+}
+
+// watchCall returns the function releasing the interest of a caller in the
+// given call, whose references are owned by mu. It is called automatically
+// when the context of the caller is done.
+func watchCall(ctx context.Context, mu sync.Locker, call *loadCall) (release func()) {
+	var once sync.Once
+	stop := make(chan struct{})
+	release = func() {
+		once.Do(func() {
+			close(stop)
+			releaseCall(mu, call)
+		})
+	}
+	if done := ctx.Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+				release()
+			case <-stop:
+			}
+		}()
+	}
+	return
+}
+
+// releaseCall removes the interest of a caller in the given call. The context
+// of the loader is cancelled when no caller is interested anymore.
+func releaseCall(mu sync.Locker, call *loadCall) {
+	mu.Lock()
+	call.refs--
+	if call.refs == 0 {
+		call.cancel()
+	}
+	mu.Unlock()
+}
+
+// finishCall finishes an in-flight call that did not populate the cache,
+// waking up the callers waiting for it.
+func (c *DiskCache) finishCall(key string, call *loadCall, err error) {
+	c.mu.Lock()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	c.mu.Unlock()
+	call.er = err
+	call.loadErr = err
+	close(call.ready)
+	close(call.done)
+}
+
+// releaseCloser calls release once the underlying ReadCloser is closed.
+type releaseCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
+}
@@ -2,9 +2,10 @@ package immcache
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -26,8 +27,20 @@ const (
 var (
 	errCorruptedCache = errors.New("immcache: corrupted")
 	errSizeNotMatch   = errors.New("immcache: size does not match")
+	errCacheClosed    = errors.New("immcache: closed")
+	errInvalidated    = errors.New("immcache: deleted while loading")
+	errEntryTooLarge  = errors.New("immcache: entry too large")
+	errMissingSecret  = errors.New("immcache: missing secret")
+	errPersistRandom  = errors.New("immcache: persisted index with a random key")
 )
 
+// secretSize is the size of the random keys of the sums.
+const secretSize = 16
+
+// tempPrefix is the prefix of the temporary files of the cache, removed when
+// found in the base directory at initialization.
+const tempPrefix = "immcache-tmp-"
+
 const (
 	inited = 1
 	closed = 2
@@ -36,52 +49,202 @@ const (
 // DiskCache implement an immutable cache using the local filesystem as its
 // persistence layer.
 type DiskCache struct {
+	stats diskStats // first for the alignment of its 64-bit atomic counters
+
 	state uint32               // 0 = non-initialized, 1 = initialized, 2 = closed
 	index Index                // owned by mu
 	size  int64                // owned by mu
 	calls map[string]*loadCall // owned by mu
+	jrnl  *journal             // owned by mu, nil if the index is not persisted
 	mu    sync.Mutex           // not a RWMutex: indexes may have write ops on read
 
+	// files stored on the disk by checksum, with the number of entries of the
+	// index referencing them: since file paths are calculated via a checksum,
+	// entries with the same content share the same file. the orphans are the
+	// files found on the disk at initialization that are not referenced by any
+	// entry, by filename. owned by mu
+	blobs   map[string]*diskBlob
+	orphans map[string]int64
+
+	// entries of a journal written under a previous key, by their sum under
+	// this key, restored once their file is re-keyed. owned by mu
+	pending map[string][]pendingEntry
+
+	verified chan struct{} // closed once the orphans found at initialization are verified
+
+	// loader errors cached by key, not stored on disk. owned by mu
+	negatives      map[string]negativeEntry
+	negativesSweep int
+
+	count int // number of entries in the index, owned by mu
+
 	// "constants" after initialization
-	basePath string
-	secret   []byte
-	sizeMax  int64
+	basePath    string
+	secret      []byte
+	prevSecrets [][]byte
+	sizeMax     int64
+	entryMax    int64
 
 	evict     chan int64
 	evictLast time.Time // owned by the eviction routine under the evict channel
 
-	opts *DiskCacheOptions
+	scrubStop chan struct{} // closed to stop the scrubber, owned by mu
+
+	fs       Storage
+	observer Observer
+	opts     *DiskCacheOptions
 }
 
+// HashMode defines the key of the HMAC sums of the contents of a DiskCache,
+// used to name their files and check their integrity.
+type HashMode int
+
+const (
+	// HashDefault uses HashKeyedConfigured when a Secret is given, and
+	// HashKeyedRandom otherwise: the files left in a fixed BasePath are only
+	// reused by the next instances of the cache with a Secret, or with the
+	// explicit HashUnkeyed mode.
+	HashDefault HashMode = iota
+	// HashKeyedRandom uses a random key of 16 bytes generated at the
+	// initialization of the cache. The files left by a previous instance
+	// cannot be checked, and are removed without being read. It cannot be
+	// used with PersistIndex.
+	HashKeyedRandom
+	// HashKeyedConfigured uses the Secret of the options, which is required.
+	HashKeyedConfigured
+	// HashUnkeyed uses plain SHA-256 sums, so that the files can be shared
+	// with other processes. It only protects against corruption, not against
+	// tampering.
+	HashUnkeyed
+)
+
 // DiskCacheOptions are the options to create a disk cache.
 type DiskCacheOptions struct {
 	BasePath       string
 	BasePathPrefix string
-	Secret         []byte
 	DiskSizeMax    int64
 
+	// Secret is the key of the sums with HashKeyedConfigured, the default mode
+	// when it is given.
+	Secret   []byte
+	HashMode HashMode
+
+	// PreviousSecrets are the keys used before a rotation of the Secret, an
+	// empty one standing for the unkeyed sums. After initialization, the
+	// files and journal left in the base directory under one of these keys are
+	// checked with it and re-keyed with the current key, in the background.
+	PreviousSecrets [][]byte
+
+	// EntrySizeMax is the maximum size of an entry, by default a tenth of
+	// DiskSizeMax. Larger contents are returned without being cached.
+	EntrySizeMax int64
+
+	// PersistIndex enables the journaling of the index in the base directory
+	// so that the cache entries survive a restart. It requires a fixed
+	// BasePath and an empty BasePathPrefix, and the same key for the sums,
+	// given by a Secret or the HashUnkeyed mode: a journal written with
+	// another key is discarded, and the cache fails to initialize with a
+	// random key. The content of the files is synced to the
+	// disk before they are committed.
+	PersistIndex bool
+
 	EvictionPeriodMin      time.Duration
 	EvictionEmergencyRatio float64
+
+	// LoadErrorPolicy defines how the callers waiting for a failed load are
+	// handled. With LoadErrorRetry, the load is retried up to LoadRetryMax
+	// times (1 by default), waiting LoadRetryBackoff before the first retry and
+	// doubling it for each of the next ones.
+	LoadErrorPolicy  LoadErrorPolicy
+	LoadRetryMax     int
+	LoadRetryBackoff time.Duration
+
+	// NegativeTTL enables the negative caching of the loader errors: during
+	// this duration, the next calls on the key return the same error without
+	// calling the loader. Only the errors for which NegativeCacheable returns
+	// true are cached, by default ErrNotFound.
+	NegativeTTL       time.Duration
+	NegativeCacheable func(err error) bool
+
+	// ScrubRate enables a background scrubber verifying the files of the
+	// cache against their sums, reading at most ScrubRate bytes per second.
+	// The entries of the corrupted or missing files are removed. A pass over
+	// all the files is started every ScrubInterval, by default a day.
+	ScrubRate     int64
+	ScrubInterval time.Duration
+
+	// Observer receives the events of the lifecycle of the cache entries.
+	Observer Observer
+
+	// Storage is the file system on which the files of the cache are stored,
+	// by default the local one.
+	Storage Storage
 }
 
 type diskEntry struct {
 	sum  []byte
 	size int64
+
+	// encoded metadata of the entry and its sum, nil if it has none.
+	meta    []byte
+	metaSum []byte
+}
+
+type diskBlob struct {
+	size   int64
+	refs   int
+	chunks [][]byte // sums of the chunks of the file, nil until computed
 }
 
 type loadCall struct {
-	sync.WaitGroup
-	er error
+	done    chan struct{} // closed when the load is finished
+	er      error
+	loadErr error // error returned by the loader
+
+	// number of previous failed attempts to load the key, and the call
+	// retrying this one if it failed. owned by mu
+	attempt int
+	next    *loadCall
+
+	// closed when the content starts being streamed into the cache, or when
+	// the load is finished without populating the cache.
+	ready  chan struct{}
+	stream *teeStream
+	meta   []byte // encoded metadata of the streamed content
+
+	// the context given to the loader, cancelled when refs drops to zero.
+	ctx    context.Context
+	cancel context.CancelFunc
+	refs   int // number of callers interested by the load, owned by mu
+
+	// set when the key is deleted while the load is in-flight: its content
+	// must not be committed. owned by mu
+	invalidated bool
 }
 
 // NewDiskCache returns a Immutable allowing to store files in the local
 // filesystem. The cached files are stored in the given base directory, or the
 // default OS temporary folder if empty, and stored using the given prefix.
 func NewDiskCache(index Index, opts DiskCacheOptions) (c *DiskCache) {
+	observer := opts.Observer
+	if observer == nil {
+		observer = NopObserver{}
+	}
+	fs := opts.Storage
+	if fs == nil {
+		fs = OSStorage{}
+	}
 	return &DiskCache{
 		index: index,
 		calls: make(map[string]*loadCall),
-		opts:  &opts,
+		blobs: make(map[string]*diskBlob),
+
+		fs:       fs,
+		observer: observer,
+		opts:     &opts,
+
+		negatives:      make(map[string]negativeEntry),
+		negativesSweep: negativeSweepMin,
 	}
 }
 
@@ -93,16 +256,40 @@ func (c *DiskCache) init() bool {
 		return state == inited
 	}
 
-	if l := len(c.opts.Secret); l > 0 {
-		c.secret = make([]byte, l)
-		copy(c.secret, c.opts.Secret)
+	var err error
+	switch c.hashMode() {
+	case HashKeyedRandom:
+		// the journal would be discarded by the next instance of the cache.
+		if c.opts.PersistIndex {
+			err = errPersistRandom
+		} else {
+			c.secret, err = genRandomBytes(secretSize)
+		}
+	case HashKeyedConfigured:
+		if l := len(c.opts.Secret); l > 0 {
+			c.secret = make([]byte, l)
+			copy(c.secret, c.opts.Secret)
+		} else {
+			err = errMissingSecret
+		}
+	}
+	if err != nil {
+		atomic.StoreUint32(&c.state, closed)
+		return false
+	}
+	for _, secret := range c.opts.PreviousSecrets {
+		var prev []byte
+		if len(secret) > 0 {
+			prev = make([]byte, len(secret))
+			copy(prev, secret)
+		}
+		c.prevSecrets = append(c.prevSecrets, prev)
 	}
 
-	var err error
 	if c.opts.BasePath == "" || c.opts.BasePathPrefix != "" {
-		c.basePath, err = ioutil.TempDir(c.opts.BasePath, c.opts.BasePathPrefix)
+		c.basePath, err = c.fs.TempDir(c.opts.BasePath, c.opts.BasePathPrefix)
 	} else {
-		c.basePath, err = c.opts.BasePath, os.MkdirAll(c.opts.BasePath, 0700)
+		c.basePath, err = c.opts.BasePath, c.fs.MkdirAll(c.opts.BasePath)
 	}
 	if err != nil {
 		atomic.StoreUint32(&c.state, closed)
@@ -110,17 +297,62 @@ func (c *DiskCache) init() bool {
 	}
 
 	c.sizeMax = c.opts.DiskSizeMax
+	c.entryMax = c.opts.EntrySizeMax
+	if c.entryMax <= 0 && c.sizeMax > 0 {
+		c.entryMax = c.sizeMax / 10
+	}
+
+	var orphans []string
+	if c.opts.BasePath != "" && c.opts.BasePathPrefix == "" {
+		// the base directory may contain the files of a previous instance of the
+		// cache. on failure to restore the index, we still use the cache with an
+		// in-memory index only, rebuilt from the scan of the directory.
+		var restored bool
+		if c.opts.PersistIndex {
+			restored, _ = c.restoreIndex()
+		}
+		orphans = c.scanBasePath(restored)
+	}
+
+	// the content of the orphans is verified in the background, not to hold
+	// the lock while reading them.
+	c.verified = make(chan struct{})
+	if len(orphans) > 0 {
+		go c.verifyOrphans(orphans, c.verified)
+	} else {
+		c.pending = nil
+		close(c.verified)
+	}
 
 	if c.sizeMax > 0 {
 		c.evict = make(chan int64, 1)
 		c.evictLast = time.Now()
-		go c.evictRoutine()
+		go c.evictRoutine(c.evict)
+		if c.size > c.sizeMax {
+			c.evict <- c.size
+		}
+	}
+
+	if c.opts.ScrubRate > 0 {
+		c.scrubStop = make(chan struct{})
+		go c.scrubRoutine(c.scrubStop)
 	}
 
 	atomic.StoreUint32(&c.state, inited)
 	return true
 }
 
+// hashMode returns the mode of the sums, resolving HashDefault.
+func (c *DiskCache) hashMode() HashMode {
+	if mode := c.opts.HashMode; mode != HashDefault {
+		return mode
+	}
+	if len(c.opts.Secret) > 0 {
+		return HashKeyedConfigured
+	}
+	return HashKeyedRandom
+}
+
 func (c *DiskCache) PurgeAndClose() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -130,19 +362,162 @@ func (c *DiskCache) PurgeAndClose() error {
 	}
 	if state == inited {
 		c.index = nil
+		if c.jrnl != nil {
+			c.jrnl.close()
+			c.jrnl = nil
+		}
 		if c.basePath != "" {
-			os.RemoveAll(c.basePath)
+			c.fs.RemoveAll(c.basePath)
 			c.basePath = ""
 		}
 		if c.evict != nil {
 			close(c.evict)
 			c.evict = nil
 		}
+		if c.scrubStop != nil {
+			close(c.scrubStop)
+			c.scrubStop = nil
+		}
 	}
 	atomic.StoreUint32(&c.state, closed)
 	return nil
 }
 
+// Close closes the cache without removing its content from the disk. When the
+// index is persisted, a new cache created with the same options will reuse the
+// entries.
+func (c *DiskCache) Close() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := atomic.LoadUint32(&c.state)
+	if state == closed {
+		return nil
+	}
+	if state == inited {
+		c.index = nil
+		if c.jrnl != nil {
+			err = c.jrnl.close()
+			c.jrnl = nil
+		}
+		if c.evict != nil {
+			close(c.evict)
+			c.evict = nil
+		}
+		if c.scrubStop != nil {
+			close(c.scrubStop)
+			c.scrubStop = nil
+		}
+	}
+	atomic.StoreUint32(&c.state, closed)
+	return
+}
+
+// Delete removes the entry of the given key from the cache and removes its
+// file from the disk. If a load of the key is in-flight, its content will not
+// be committed into the cache.
+func (c *DiskCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if atomic.LoadUint32(&c.state) != inited {
+		return nil
+	}
+	return c.deleteLocked(key)
+}
+
+// DeleteFunc removes all the entries, in-flight loads and cached load errors,
+// for which the given function returns true.
+func (c *DiskCache) DeleteFunc(fn func(key string) bool) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if atomic.LoadUint32(&c.state) != inited {
+		return nil
+	}
+	var keys []string
+	c.index.Range(func(key string, _ interface{}) bool {
+		if fn(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for key := range c.calls {
+		if fn(key) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range c.negatives {
+		if fn(key) {
+			delete(c.negatives, key)
+		}
+	}
+	for _, key := range keys {
+		if errd := c.deleteLocked(key); err == nil {
+			err = errd
+		}
+	}
+	return
+}
+
+func (c *DiskCache) deleteLocked(key string) error {
+	delete(c.negatives, key)
+	if call, ok := c.calls[key]; ok {
+		call.invalidated = true
+	}
+	value, ok := c.index.Remove(key)
+	if !ok {
+		return nil
+	}
+	if c.jrnl != nil {
+		c.journalErrLocked(c.jrnl.remove(key))
+	}
+	_, err := c.releaseLocked(value.(diskEntry))
+	return err
+}
+
+// retainLocked adds a reference to the file of the given entry.
+func (c *DiskCache) retainLocked(entry diskEntry) {
+	c.count++
+	if blob, ok := c.blobs[string(entry.sum)]; ok {
+		blob.refs++
+		return
+	}
+	filename := c.getFilename(entry.sum)
+	if size, ok := c.orphans[filename]; ok {
+		// the orphan file is now referenced, its size is already accounted.
+		delete(c.orphans, filename)
+		c.blobs[string(entry.sum)] = &diskBlob{size: size, refs: 1}
+		return
+	}
+	c.blobs[string(entry.sum)] = &diskBlob{size: entry.size, refs: 1}
+	c.size += entry.size
+}
+
+// releaseLocked removes a reference to the file of the given entry. The file
+// is removed from the disk when it is not referenced anymore, in which case its
+// size is returned. If the removal fails, the file is kept as an orphan to be
+// removed by a later eviction.
+func (c *DiskCache) releaseLocked(entry diskEntry) (freed int64, err error) {
+	blob, ok := c.blobs[string(entry.sum)]
+	if !ok {
+		return
+	}
+	c.count--
+	if blob.refs--; blob.refs > 0 {
+		return
+	}
+	delete(c.blobs, string(entry.sum))
+	filename := c.getFilename(entry.sum)
+	err = c.fs.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		if c.orphans == nil {
+			c.orphans = make(map[string]int64)
+		}
+		c.orphans[filename] = blob.size
+		return
+	}
+	c.size -= blob.size
+	return blob.size, nil
+}
+
 func (c *DiskCache) BasePath() string {
 	if atomic.LoadUint32(&c.state) == inited {
 		return c.basePath
@@ -150,27 +525,57 @@ func (c *DiskCache) BasePath() string {
 	return ""
 }
 
-func (c *DiskCache) GetOrLoad(key string, loader Loader) (rc io.ReadCloser, err error) {
+func (c *DiskCache) GetOrLoad(key string, loader Loader) (io.ReadCloser, error) {
+	return c.GetOrLoadContext(context.Background(), key, contextLoader{loader})
+}
+
+// GetOrLoadContext is like GetOrLoad but the given context can be used to give
+// up waiting for an in-flight load of the same key. The context given to the
+// loader carries the values of the context of the call that started the load,
+// and is cancelled once all the callers interested by the load have given up.
+func (c *DiskCache) GetOrLoadContext(ctx context.Context, key string, loader ContextLoader) (rc io.ReadCloser, err error) {
+	rc, _, err = c.GetOrLoadMetadata(ctx, key, metadataLoader{loader})
+	return
+}
+
+// GetOrLoadMetadata is like GetOrLoadContext but also returns the metadata of
+// the content, as returned by the loader when the content was loaded. The
+// metadata is stored with the entry and authenticated like its content: a
+// tampered metadata drops the entry when the index is restored.
+func (c *DiskCache) GetOrLoadMetadata(ctx context.Context, key string, loader MetadataLoader) (rc io.ReadCloser, meta *Metadata, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
 	if atomic.LoadUint32(&c.state) == inited || c.init() {
-		return c.getOrLoad(key, loader)
+		return c.getOrLoad(ctx, key, loader, nil)
 	}
-	_, rc, err = loader.Load(key)
+	_, meta, rc, err = c.load(ctx, key, loader)
 	return
 }
 
-func (c *DiskCache) getOrLoad(key string, loader Loader) (src io.ReadCloser, err error) {
+// getOrLoad returns the content of the given key. When retrying a failed load,
+// prev is the failed call: all its waiters join the same new call.
+func (c *DiskCache) getOrLoad(ctx context.Context, key string, loader MetadataLoader, prev *loadCall) (src io.ReadCloser, meta *Metadata, err error) {
 	var entry diskEntry
 	var call *loadCall
-	var cacheHit, callHit bool
+	var cacheHit, callHit, teeHit bool
+	var release func()
 
 	defer func() {
-		didLoad := !callHit && !cacheHit
+		// if the loaded content is not streamed through a diskTee, the in-flight
+		// call is finished without populating the cache. when returned to the
+		// caller, the source keeps the interest on the call until it is closed.
+		didLoad := call != nil && !callHit && !cacheHit
 		if didLoad && err != nil {
-			c.mu.Lock()
-			delete(c.calls, key)
-			c.mu.Unlock()
-			call.er = err
-			call.Done()
+			c.setNegative(key, err)
+		}
+		if didLoad && !teeHit {
+			c.finishCall(key, call, err)
+			if err == nil {
+				src = &releaseCloser{src, release}
+			} else {
+				release()
+			}
 		}
 	}()
 
@@ -178,28 +583,91 @@ func (c *DiskCache) getOrLoad(key string, loader Loader) (src io.ReadCloser, err
 		c.mu.Lock()
 		entry, cacheHit = c.get(key)
 		if !cacheHit {
-			if call, callHit = c.calls[key]; !callHit {
-				call = new(loadCall)
-				call.Add(1)
+			if errn := c.getNegative(key); errn != nil {
+				c.mu.Unlock()
+				return nil, nil, errn
+			}
+			if prev != nil && prev.next != nil {
+				call, callHit = prev.next, true
+			} else {
+				call, callHit = c.calls[key]
+			}
+			if !callHit {
+				call = newLoadCall(ctx)
+				if prev != nil {
+					call.attempt = prev.attempt + 1
+				}
 				c.calls[key] = call
+				atomic.AddInt64(&c.stats.misses, 1)
+			} else {
+				call.refs++
+				atomic.AddInt64(&c.stats.coalesced, 1)
+			}
+			if prev != nil && prev.next == nil {
+				prev.next = call
 			}
 		}
 		c.mu.Unlock()
 	}
 
-	// another call on the given key is in-flight: waitint for it to finish to
-	// avoid multiple calls on the same key while populating the cache. if the
+	if !cacheHit {
+		release = watchCall(ctx, &c.mu, call)
+		if callHit {
+			c.observer.OnCoalesced(ctx, key)
+		} else {
+			c.observer.OnMiss(ctx, key)
+		}
+	}
+
+	// another call on the given key is in-flight: we follow the content as it
+	// is streamed into the cache to avoid multiple calls on the same key. if
+	// the content is not streamed, we wait for the call to finish. if the
 	// in-flight has failed, we call the loader and bail without populating the
 	// cache.
 	if callHit {
-		call.Wait()
+		select {
+		case <-call.ready:
+		case <-ctx.Done():
+			release()
+			return nil, nil, ctx.Err()
+		}
+		load := func(off int64) (io.ReadCloser, error) {
+			return c.loadAt(ctx, key, loader, off)
+		}
+		if f, ok := call.stream.follow(ctx, release, load); ok {
+			return f, decodeMetadata(call.meta), nil
+		}
+		select {
+		case <-call.done:
+			release()
+		case <-ctx.Done():
+			release()
+			return nil, nil, ctx.Err()
+		}
+		if call.loadErr != nil && c.negativeCacheable(call.loadErr) {
+			return nil, nil, call.loadErr
+		}
+		if call.loadErr != nil {
+			switch c.opts.LoadErrorPolicy {
+			case LoadErrorShare:
+				return nil, nil, call.loadErr
+			case LoadErrorRetry:
+				if call.attempt >= c.loadRetryMax() {
+					return nil, nil, call.loadErr
+				}
+				if err = c.loadRetryWait(ctx, call.attempt); err != nil {
+					return
+				}
+				return c.getOrLoad(ctx, key, loader, call)
+			}
+		}
 		if call.er == nil {
 			c.mu.Lock()
 			entry, cacheHit = c.get(key)
 			c.mu.Unlock()
 		}
 		if call.er != nil || !cacheHit {
-			_, src, err = loader.Load(key)
+			_, meta, src, err = c.load(ctx, key, loader)
 			return
 		}
 		call = nil
@@ -209,29 +677,44 @@ func (c *DiskCache) getOrLoad(key string, loader Loader) (src io.ReadCloser, err
 	// for an in-flight loader to finish: open the file with the specified
 	// checksum.
 	if cacheHit {
-		src, err = c.openFile(entry.sum)
+		src, err = c.openFile(key, entry)
 		if err == nil {
+			meta = decodeMetadata(entry.meta)
+			atomic.AddInt64(&c.stats.hits, 1)
+			c.observer.OnHit(ctx, key)
 			return
 		}
 		// if we hitted another error than "file does not exist" — meaning there
 		// is an issue fetching files from the local disk — we bail early and
 		// return the loader value.
 		if !os.IsNotExist(err) {
-			_, src, err = loader.Load(key)
+			_, meta, src, err = c.load(ctx, key, loader)
 			return
 		}
+		// the file has been removed behind the entry, for instance by the
+		// deletion of another key with the same content: we drop the stale entry
+		// and start over.
+		c.mu.Lock()
+		if current, ok := c.get(key); ok && bytes.Equal(current.sum, entry.sum) {
+			c.deleteLocked(key)
+		}
+		c.mu.Unlock()
+		return c.getOrLoad(ctx, key, loader, nil)
 	}
 
 	// at this point, we are launching a new load request.
 
 	var size int64
-	size, src, err = loader.Load(key)
-	if err != nil || size < 0 {
+	size, meta, src, err = c.load(call.ctx, key, loader)
+	if err != nil {
 		return
 	}
-	// if file size takes more than the tenth of the total available size of the
-	// cache, do not put this file into the cache.
-	if c.sizeMax > 0 && size/10 > c.sizeMax {
+	// if file size takes more than the maximum size of an entry, by default the
+	// tenth of the total available size of the cache, do not put this file into
+	// the cache. if the size is unknown (negative), it is checked while
+	// streaming the content.
+	if c.entryMax > 0 && size > c.entryMax {
+		c.observer.OnBypass(call.ctx, key, size)
 		return
 	}
 
@@ -239,79 +722,220 @@ func (c *DiskCache) getOrLoad(key string, loader Loader) (src io.ReadCloser, err
 	// the temporary file is created in the basePath to make sure we can safely
 	// rename the file to its destination without having a copy (ie. from the
 	// same device/partition).
-	tmp, errt := ioutil.TempFile(c.basePath, "")
+	tmp, errt := c.fs.CreateTemp(c.basePath, tempPrefix)
 	if errt != nil {
 		return
 	}
 
+	teeHit = true
+	call.stream = newTeeStream(c.fs, tmp.Name())
+	call.meta = encodeMetadata(meta)
+	close(call.ready)
 	return &diskTee{
-		src:  src,
-		tmp:  tmp,
-		key:  key,
-		call: call,
-		size: size,
-		c:    c,
-		h:    c.hash(),
-	}, nil
+		src:     src,
+		tmp:     tmp,
+		key:     key,
+		call:    call,
+		release: release,
+		size:    size,
+		max:     c.entryMax,
+		c:       c,
+		h:       c.hash(),
+		chunks:  newChunkHasher(c.hash),
+	}, meta, nil
 }
 
-func (c *DiskCache) addFileLocked(err error, tmppath, key string, size int64, sum []byte) error {
-	var totalSize int64
+func (c *DiskCache) load(ctx context.Context, key string, loader MetadataLoader) (size int64, meta *Metadata, src io.ReadCloser, err error) {
+	c.observer.OnLoadStart(ctx, key)
+	start := time.Now()
+	size, meta, src, err = loader.LoadMetadata(ctx, key)
+	if err != nil {
+		atomic.AddInt64(&c.stats.loadErrors, 1)
+	}
+	c.observer.OnLoadDone(ctx, key, size, err, time.Since(start))
+	return
+}
+
+// loadAt calls the loader without populating the cache, and returns its content
+// from the given offset.
+func (c *DiskCache) loadAt(ctx context.Context, key string, loader MetadataLoader, off int64) (io.ReadCloser, error) {
+	_, _, src, err := c.load(ctx, key, loader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.CopyN(ioutil.Discard, src, off); err != nil {
+		src.Close()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return src, nil
+}
 
+func (c *DiskCache) loadRetryMax() int {
+	if c.opts.LoadRetryMax > 0 {
+		return c.opts.LoadRetryMax
+	}
+	return 1
+}
+
+// loadRetryWait waits before retrying the load of a key after the given number
+// of failed attempts.
+func (c *DiskCache) loadRetryWait(ctx context.Context, attempt int) error {
+	backoff := c.opts.LoadRetryBackoff << uint(attempt)
+	if backoff <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *DiskCache) addFileLocked(err error, tmppath, key string, call *loadCall, entry diskEntry, chunks [][]byte) error {
 	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil && atomic.LoadUint32(&c.state) != inited {
+		err = errCacheClosed
+	}
+	if err == nil && call.invalidated {
+		err = errInvalidated
+	}
 	if err == nil {
-		err = c.rename(tmppath, sum)
-		if err == nil || os.IsExist(err) {
-			c.index.Set(key, diskEntry{sum, size})
+		err = c.rename(tmppath, entry.sum)
+		if os.IsExist(err) {
+			filename := c.getFilename(entry.sum)
+			if size, ok := c.orphans[filename]; ok {
+				// the orphan may not be verified yet: it is replaced by the
+				// loaded content, which matches its sum.
+				if err = c.fs.Rename(tmppath, filename); err == nil {
+					c.orphans[filename] = entry.size
+					c.size += entry.size - size
+				}
+			} else {
+				// the same content is already stored by another entry.
+				err = nil
+				c.fs.Remove(tmppath)
+			}
 		}
 		if err == nil {
-			c.size += size
-			totalSize = c.size
+			if entry.meta != nil {
+				entry.metaSum = metadataSum(c.hash(), entry.sum, entry.meta)
+			}
+			// the new entry is retained first, not to remove its file when it
+			// is shared with the old one.
+			old, ok := c.index.Get(key)
+			c.retainLocked(entry)
+			if ok {
+				c.releaseLocked(old.(diskEntry))
+			}
+			if blob := c.blobs[string(entry.sum)]; blob.chunks == nil {
+				blob.chunks = chunks
+			}
+			c.index.Set(key, entry)
+			delete(c.negatives, key)
+			if c.jrnl != nil {
+				c.journalErrLocked(c.jrnl.set(key, entry))
+			}
+		}
+		if c.sizeMax > 0 && c.size > c.sizeMax {
+			select {
+			case c.evict <- c.size:
+			default:
+			}
 		}
 	}
-	delete(c.calls, key)
-	c.mu.Unlock()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	return err
+}
 
-	if c.sizeMax > 0 && totalSize > c.sizeMax {
-		select {
-		case c.evict <- totalSize:
-		default:
-		}
+// journalErrLocked drops the journal after a failed write. The cache keeps
+// working with its in-memory index, and the incomplete journal is removed so
+// that it is not replayed.
+func (c *DiskCache) journalErrLocked(err error) {
+	if err != nil {
+		c.jrnl.close()
+		c.fs.Remove(c.jrnl.filename)
+		c.jrnl = nil
 	}
+}
 
-	return err
+// restoreIndex replays the journal of the base directory into the index,
+// keeping only the entries whose files are still present on the disk, and
+// opens the journal for the next operations. It returns whether or not a
+// journal was replayed. The entries of a journal written with a previous key
+// are pending until their files are re-keyed by verifyOrphans, and a journal
+// written with another key is not replayed.
+func (c *DiskCache) restoreIndex() (restored bool, err error) {
+	filename := filepath.Join(c.basePath, journalFilename)
+	keyID := secretKeyID(c.secret)
+	entries, entriesKeyID, err := replayJournal(c.fs, filename)
+	if err == nil {
+		restored = hmac.Equal(entriesKeyID, keyID)
+		if prev, ok := c.previousSecret(entriesKeyID); !restored && ok {
+			c.pending = pendingEntries(entries, prev)
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	if !restored {
+		entries, err = LRUIndex(), nil
+	}
+	for e := entries.l.Back(); e != nil; {
+		prev := e.Prev()
+		ent := e.Value.(*lruEntry)
+		entry := ent.v.(diskEntry)
+		if !c.validMetadata(entry) {
+			// the metadata of the entry has been tampered with.
+			entries.Remove(ent.k)
+		} else if fi, errs := c.fs.Stat(c.getFilename(entry.sum)); errs != nil || fi.Size() != entry.size {
+			entries.Remove(ent.k)
+		} else {
+			c.retainLocked(entry)
+			c.index.Set(ent.k, entry)
+		}
+		e = prev
+	}
+	if err = writeJournal(c.fs, filename, keyID, entries); err != nil {
+		return
+	}
+	c.jrnl, err = openJournal(c.fs, filename, keyID, entries.l.Len())
+	return
 }
 
 func (c *DiskCache) hash() hash.Hash {
-	if c.secret != nil {
-		return hmac.New(sha256.New, c.secret)
-	}
-	return sha256.New()
+	return newHash(c.secret)
 }
 
 func (c *DiskCache) rename(tmppath string, sum []byte) (err error) {
 	newpath := c.getFilename(sum)
-	err = os.MkdirAll(filepath.Dir(newpath), 0700)
+	err = c.fs.MkdirAll(filepath.Dir(newpath))
 	if err != nil && !os.IsExist(err) {
 		return
 	}
 	// make sure we cannot concurrently create the same file and messing the size
 	// of the cache. since file paths are calculated via a checksum, two files
 	// with different keys but with the same content will collide.
-	f, err := os.OpenFile(newpath, os.O_CREATE|os.O_EXCL, 0600)
-	if err != nil {
-		return
-	}
-	if err = f.Close(); err != nil {
-		return
-	}
-	return os.Rename(tmppath, newpath)
+	return c.fs.RenameExclusive(tmppath, newpath)
 }
 
 func (c *DiskCache) get(key string) (entry diskEntry, ok bool) {
+	if c.index == nil {
+		return
+	}
 	var value interface{}
 	if value, ok = c.index.Get(key); ok {
 		entry = value.(diskEntry)
+		if c.jrnl != nil {
+			c.jrnl.hit(key)
+		}
 	}
 	return
 }
@@ -321,20 +945,24 @@ func (c *DiskCache) getFilename(sum []byte) string {
 	return filepath.Join(c.basePath, key[:2], key[2:32])
 }
 
-func (c *DiskCache) openFile(sum []byte) (*diskFile, error) {
-	filename := c.getFilename(sum)
-	f, err := os.Open(filename)
+func (c *DiskCache) openFile(key string, entry diskEntry) (*diskFile, error) {
+	filename := c.getFilename(entry.sum)
+	f, err := c.fs.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	return &diskFile{
-		f:   f,
-		h:   c.hash(),
-		sum: sum,
+		f:    f,
+		h:    c.hash(),
+		sum:  entry.sum,
+		size: entry.size,
+		meta: entry.meta,
+		key:  key,
+		c:    c,
 	}, nil
 }
 
-func (c *DiskCache) evictRoutine() {
+func (c *DiskCache) evictRoutine(evict <-chan int64) {
 	evictionPeriodMin := c.opts.EvictionPeriodMin
 	evictionEmergencyRatio := c.opts.EvictionEmergencyRatio
 	if evictionPeriodMin == 0 {
@@ -343,7 +971,7 @@ func (c *DiskCache) evictRoutine() {
 	if evictionEmergencyRatio < 1.0 {
 		evictionEmergencyRatio = defaultEvictionEmergencyRatio
 	}
-	for size := range c.evict {
+	for size := range evict {
 		runEviction := time.Until(c.evictLast) >= evictionPeriodMin ||
 			float64(size)/float64(c.sizeMax) >= evictionEmergencyRatio
 		if runEviction {
@@ -356,25 +984,51 @@ func (c *DiskCache) evictRoutine() {
 func (c *DiskCache) eviction() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if atomic.LoadUint32(&c.state) != inited {
+		return
+	}
+	atomic.AddInt64(&c.stats.evictionRuns, 1)
+	for filename, size := range c.orphans {
+		if c.size <= c.sizeMax {
+			return
+		}
+		err := c.fs.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+		delete(c.orphans, filename)
+		c.size -= size
+		atomic.AddInt64(&c.stats.evictedBytes, size)
+	}
 	for c.size > c.sizeMax {
-		_, value, ok := c.index.RemoveUnused()
+		key, value, ok := c.index.RemoveUnused()
 		if !ok {
 			break
 		}
-		entry := value.(diskEntry)
-		err := os.Remove(c.getFilename(entry.sum))
-		if err != nil && !os.IsNotExist(err) {
+		if c.jrnl != nil {
+			c.journalErrLocked(c.jrnl.remove(key))
+		}
+		atomic.AddInt64(&c.stats.evictedEntries, 1)
+		c.observer.OnEvict(key, value.(diskEntry).size)
+		freed, err := c.releaseLocked(value.(diskEntry))
+		if err != nil {
 			break
 		}
-		c.size -= entry.size
+		atomic.AddInt64(&c.stats.evictedBytes, freed)
 	}
 }
 
 type diskFile struct {
-	f   *os.File
-	h   hash.Hash
-	bfr *bufio.Reader
-	sum []byte
+	f    File
+	h    hash.Hash
+	bfr  *bufio.Reader
+	sum  []byte
+	size int64
+	meta []byte
+	eof  bool
+
+	key string
+	c   *DiskCache
 }
 
 func (f *diskFile) Read(p []byte) (n int, err error) {
@@ -385,15 +1039,20 @@ func (f *diskFile) Read(p []byte) (n int, err error) {
 	if n > 0 {
 		f.h.Write(p[:n])
 	}
+	if err == io.EOF {
+		f.eof = true
+	}
 	return
 }
 
+// Close closes the file and checks the integrity of its content if it has been
+// read entirely.
 func (f *diskFile) Close() (err error) {
 	if err = f.f.Close(); err != nil {
 		return
 	}
-	if !hmac.Equal(f.h.Sum(nil), f.sum) {
-		os.Remove(f.f.Name())
+	if f.eof && !hmac.Equal(f.h.Sum(nil), f.sum) {
+		f.c.corruptedFile(f.key, f.f.Name())
 		return errCorruptedCache
 	}
 	return
@@ -401,18 +1060,23 @@ func (f *diskFile) Close() (err error) {
 
 type diskTee struct {
 	src  io.ReadCloser
-	tmp  *os.File
+	tmp  File
 	bfr  *bufio.Writer
 	key  string
-	size int64
+	size int64 // negative if unknown
+	max  int64
 
-	c *DiskCache
-	h hash.Hash
+	c      *DiskCache
+	h      hash.Hash
+	chunks *chunkHasher
 
-	call *loadCall
+	call    *loadCall
+	release func()
 
-	n int64
-	e error
+	n   int64
+	e   error // error writing the temporary file
+	er  error // error reading the source
+	eof bool
 }
 
 func (t *diskTee) Read(p []byte) (n int, err error) {
@@ -421,43 +1085,99 @@ func (t *diskTee) Read(p []byte) (n int, err error) {
 		t.bfr = bufio.NewWriter(t.tmp)
 	}
 	if n > 0 && t.e == nil {
-		nw, errw := t.bfr.Write(p[:n])
-		if errw != nil {
+		if t.max > 0 && t.n+int64(n) > t.max {
+			// the content keeps on being returned to the caller, but is not
+			// cached: the followers load the rest of it on their own.
+			t.e = errEntryTooLarge
+		} else if nw, errw := t.bfr.Write(p[:n]); errw != nil {
 			t.e = errw
 		} else if nw != n {
 			t.e = io.ErrShortWrite
 		} else {
 			t.h.Write(p[:n])
+			t.chunks.Write(p[:n])
 			t.n += int64(n)
 		}
 	}
+	if err == io.EOF {
+		t.eof = true
+	} else if err != nil && t.er == nil {
+		t.er = err
+	}
+	// the followers can only read the content flushed to the file.
+	if t.call.stream.following() {
+		if t.e == nil {
+			t.e = t.bfr.Flush()
+		}
+		if t.e != nil {
+			t.call.stream.fail()
+		} else {
+			t.call.stream.publish(t.n, t.er, false)
+		}
+	}
 	return
 }
 
 func (t *diskTee) Close() (err error) {
+	// if followers are still reading the content after the caller has given up,
+	// the source is drained in the background.
+	if !t.eof && t.e == nil && t.er == nil && t.call.stream.drain() {
+		t.release()
+		go func() {
+			io.Copy(ioutil.Discard, t)
+			t.finish()
+		}()
+		return nil
+	}
+	return t.finish()
+}
+
+func (t *diskTee) finish() (err error) {
+	start := time.Now()
 	errc := t.src.Close()
 	var errw error
 	if t.bfr != nil {
 		errw = t.bfr.Flush()
 	}
+	if errw == nil && t.e == nil && t.er == nil && t.c.opts.PersistIndex {
+		// the file is referenced by the journal once committed: its content
+		// must reach the disk first, not to be restored as garbage after a
+		// power loss.
+		errw = t.tmp.Sync()
+	}
 	if errwc := t.tmp.Close(); errw == nil {
 		errw = errwc
 	}
 	if errw == nil {
 		errw = t.e
 	}
-	if errw == nil && t.n != t.size {
-		errw = errSizeNotMatch
-	}
-	errw = t.c.addFileLocked(errw, t.tmp.Name(), t.key, t.size, t.h.Sum(nil))
 	if errw != nil {
-		os.Remove(t.tmp.Name())
+		// the file is incomplete because of the cache, not of the source.
+		t.call.stream.fail()
+	}
+	errs := t.er
+	if errs == nil && t.size < 0 && !t.eof {
+		errs = io.ErrUnexpectedEOF
+	}
+	if errs == nil && t.size >= 0 && t.n != t.size {
+		errs = errSizeNotMatch
 	}
-	// wake the entry's waitgroup
-	if t.call != nil {
-		t.call.er = errw
-		t.call.Done()
+	t.call.stream.publish(t.n, errs, true)
+	if errw == nil {
+		errw = errs
+	}
+	// the size of the content is committed with its measured length.
+	entry := diskEntry{sum: t.h.Sum(nil), size: t.n, meta: t.call.meta}
+	errw = t.c.addFileLocked(errw, t.tmp.Name(), t.key, t.call, entry, t.chunks.Sums())
+	t.c.observer.OnCommit(t.call.ctx, t.key, t.n, errw, time.Since(start))
+	if errw != nil {
+		t.c.fs.Remove(t.tmp.Name())
 	}
+	// wake the callers waiting for the entry
+	t.call.er = errw
+	close(t.call.done)
+	t.release()
+	t.call.cancel()
 	return errc
 }
 
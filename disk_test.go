@@ -2,12 +2,17 @@ package immcache
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -161,6 +166,892 @@ func TestDiskCache(t *testing.T) {
 	}
 }
 
+func TestDiskCachePersistIndex(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "cozy-disk-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(basePath)
+
+	opts := DiskCacheOptions{
+		BasePath:     basePath,
+		HashMode:     HashUnkeyed,
+		PersistIndex: true,
+	}
+
+	cache := NewDiskCache(LRUIndex(), opts)
+	for _, key := range []string{"key1", "key 2", "key\n3"} {
+		rc, err := cache.GetOrLoad(key, bytesLoader([]byte("content of "+key)))
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+	}
+
+	// the hits are only written with the next commit or on close
+	filename := filepath.Join(basePath, journalFilename)
+	fi, err := os.Stat(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rc, err := cache.GetOrLoad("key1", bytesLoader([]byte("content of key1")))
+	if assert.NoError(t, err) {
+		assert.NoError(t, rc.Close())
+	}
+	if fi2, err := os.Stat(filename); assert.NoError(t, err) {
+		assert.Equal(t, fi.Size(), fi2.Size())
+	}
+	assert.NoError(t, cache.Close())
+	b, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasSuffix(b, []byte("g \"key1\"\n")))
+
+	cache = NewDiskCache(LRUIndex(), opts)
+	defer cache.PurgeAndClose()
+	var size int64
+	for _, key := range []string{"key1", "key 2", "key\n3"} {
+		rc, err := cache.GetOrLoad(key, FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+			return 0, nil, errTestFail
+		}))
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, isFile := rc.(*diskFile)
+		assert.True(t, isFile)
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		assert.Equal(t, []byte("content of "+key), b)
+		size += int64(len(b))
+	}
+	assert.Equal(t, size, cache.size)
+}
+
+func TestDiskCacheMemStorage(t *testing.T) {
+	fs := NewMemStorage()
+	opts := DiskCacheOptions{
+		BasePath:     "/cache",
+		HashMode:     HashUnkeyed,
+		PersistIndex: true,
+		Storage:      fs,
+	}
+
+	cache := NewDiskCache(LRUIndex(), opts)
+	for _, key := range []string{"key1", "key2"} {
+		rc, err := cache.GetOrLoad(key, bytesLoader([]byte("content of "+key)))
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+	}
+	entry, ok := cache.index.Get("key2")
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.NoError(t, cache.Close())
+
+	f, err := fs.OpenAppend(cache.getFilename(entry.(diskEntry).sum))
+	if assert.NoError(t, err) {
+		f.Write([]byte("!"))
+		f.Close()
+	}
+
+	cache = NewDiskCache(LRUIndex(), opts)
+	defer cache.PurgeAndClose()
+	rc, err := cache.GetOrLoad("key1", FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+		return 0, nil, errTestFail
+	}))
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		assert.Equal(t, "content of key1", string(b))
+	}
+	// the file of key2 does not match the size of its entry anymore
+	_, err = cache.GetOrLoad("key2", FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+		return 0, nil, errTestFail
+	}))
+	assert.Equal(t, errTestFail, err)
+}
+
+func TestDiskCacheScanBasePath(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "cozy-disk-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(basePath)
+
+	opts := DiskCacheOptions{BasePath: basePath, HashMode: HashUnkeyed}
+
+	cache := NewDiskCache(LRUIndex(), opts)
+	var filenames []string
+	for _, key := range []string{"valid", "corrupted"} {
+		rc, err := cache.GetOrLoad(key, bytesLoader([]byte(key)))
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		entry, _ := cache.get(key)
+		filenames = append(filenames, cache.getFilename(entry.sum))
+	}
+	assert.NoError(t, cache.Close())
+
+	assert.NoError(t, ioutil.WriteFile(filenames[1], []byte("garbage"), 0600))
+	tmp, err := ioutil.TempFile(basePath, tempPrefix)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, tmp.Close())
+	// the files not created by the cache are kept
+	foreign := []string{filepath.Join(basePath, "notes.txt"), filepath.Join(filepath.Dir(filenames[0]), "readme")}
+	for _, filename := range foreign {
+		assert.NoError(t, ioutil.WriteFile(filename, []byte("foreign"), 0600))
+	}
+
+	cache = NewDiskCache(LRUIndex(), opts)
+	defer cache.PurgeAndClose()
+	assert.True(t, cache.init())
+	<-cache.verified
+
+	_, err = os.Stat(tmp.Name())
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filenames[1])
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filenames[0])
+	assert.NoError(t, err)
+	for _, filename := range foreign {
+		_, err = os.Stat(filename)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, cache.orphans, 1)
+	assert.Equal(t, int64(len("valid")), cache.size)
+
+	// an orphan is replaced by the loaded content, as it may not be verified
+	assert.NoError(t, ioutil.WriteFile(filenames[0], []byte("garbage"), 0600))
+	rc, err := cache.GetOrLoad("valid", bytesLoader([]byte("valid")))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.Len(t, cache.orphans, 0)
+	assert.Equal(t, int64(len("valid")), cache.size)
+	b, err := ioutil.ReadFile(filenames[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "valid", string(b))
+}
+
+func TestDiskCacheHashMode(t *testing.T) {
+	// a temporary cache uses a random key by default
+	var secrets [][]byte
+	for i := 0; i < 2; i++ {
+		cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+			BasePath:       os.TempDir(),
+			BasePathPrefix: "cozy-disk-test",
+		})
+		assert.True(t, cache.init())
+		assert.Len(t, cache.secret, secretSize)
+		secrets = append(secrets, cache.secret)
+		assert.NoError(t, cache.PurgeAndClose())
+	}
+	assert.NotEqual(t, secrets[0], secrets[1])
+
+	// a configured key is required
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-disk-test",
+		HashMode:       HashKeyedConfigured,
+	})
+	assert.False(t, cache.init())
+	rc, err := cache.GetOrLoad("key", bytesLoader([]byte("content")))
+	if assert.NoError(t, err) {
+		assert.NoError(t, rc.Close())
+	}
+
+	// the files written under a key are rejected under another one
+	for _, test := range []struct {
+		name    string
+		opts    [2]DiskCacheOptions
+		rejects bool
+	}{
+		{"secrets", [2]DiskCacheOptions{{Secret: []byte("secret1")}, {Secret: []byte("secret2")}}, true},
+		{"random", [2]DiskCacheOptions{{HashMode: HashKeyedRandom}, {HashMode: HashKeyedRandom}}, true},
+		{"default", [2]DiskCacheOptions{{}, {}}, true},
+		{"unkeyed", [2]DiskCacheOptions{{Secret: []byte("secret1")}, {HashMode: HashUnkeyed}}, true},
+		{"same secret", [2]DiskCacheOptions{{Secret: []byte("secret1")}, {Secret: []byte("secret1")}}, false},
+		{"shared unkeyed", [2]DiskCacheOptions{{HashMode: HashUnkeyed}, {HashMode: HashUnkeyed, Secret: []byte("ignored")}}, false},
+	} {
+		for _, persist := range []bool{false, true} {
+			if cache := NewDiskCache(LRUIndex(), test.opts[0]); persist && cache.hashMode() == HashKeyedRandom {
+				// the journal of a random key would always be discarded
+				cache.opts.PersistIndex = true
+				assert.False(t, cache.init(), test.name)
+				continue
+			}
+			basePath, err := ioutil.TempDir("", "cozy-disk-test")
+			if !assert.NoError(t, err) {
+				return
+			}
+			var loads int
+			loader := FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+				loads++
+				return 7, ioutil.NopCloser(bytes.NewReader([]byte("content"))), nil
+			})
+			var filename string
+			for i, opts := range test.opts {
+				opts.BasePath = basePath
+				opts.PersistIndex = persist
+				cache := NewDiskCache(LRUIndex(), opts)
+				assert.True(t, cache.init(), test.name)
+				<-cache.verified
+				rc, err := cache.GetOrLoad("key", loader)
+				if assert.NoError(t, err, test.name) {
+					b, err := ioutil.ReadAll(rc)
+					assert.NoError(t, err, test.name)
+					assert.NoError(t, rc.Close(), test.name)
+					assert.Equal(t, "content", string(b), test.name)
+				}
+				assert.Equal(t, int64(7), cache.size, test.name)
+				entry, _ := cache.get("key")
+				if i == 0 {
+					filename = cache.getFilename(entry.sum)
+				} else {
+					_, err = os.Stat(filename)
+					assert.Equal(t, test.rejects, os.IsNotExist(err), test.name)
+				}
+				assert.NoError(t, cache.Close())
+			}
+			if test.rejects || !persist {
+				assert.Equal(t, 2, loads, test.name)
+			} else {
+				assert.Equal(t, 1, loads, test.name)
+			}
+			os.RemoveAll(basePath)
+		}
+	}
+
+	// the files left under a random key are removed without being verified
+	basePath, err := ioutil.TempDir("", "cozy-disk-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(basePath)
+	filename := filepath.Join(basePath, "ab", strings.Repeat("0", 30))
+	assert.NoError(t, os.MkdirAll(filepath.Dir(filename), 0700))
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("content"), 0600))
+	cache = NewDiskCache(LRUIndex(), DiskCacheOptions{BasePath: basePath})
+	assert.True(t, cache.init())
+	select {
+	case <-cache.verified:
+	default:
+		t.Error("the orphans of a random key are verified")
+	}
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, int64(0), cache.size)
+	assert.NoError(t, cache.Close())
+}
+
+func TestDiskCacheDelete(t *testing.T) {
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-disk-test",
+	})
+	defer cache.PurgeAndClose()
+
+	load := func(key string) (io.ReadCloser, error) {
+		rc, err := cache.GetOrLoad(key, bytesLoader([]byte("content of "+key)))
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(b, []byte("content of "+key)) {
+			return nil, errTestFail
+		}
+		return rc, rc.Close()
+	}
+
+	for _, key := range []string{"a/1", "a/2", "b/1"} {
+		_, err := load(key)
+		assert.NoError(t, err)
+	}
+
+	entry, ok := cache.get("a/1")
+	assert.True(t, ok)
+	assert.NoError(t, cache.Delete("a/1"))
+	_, ok = cache.get("a/1")
+	assert.False(t, ok)
+	_, err := os.Stat(cache.getFilename(entry.sum))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, int64(2*len("content of a/1")), cache.size)
+	assert.NoError(t, cache.Delete("a/1"))
+
+	assert.NoError(t, cache.DeleteFunc(func(key string) bool {
+		return strings.HasPrefix(key, "a/")
+	}))
+	_, ok = cache.get("a/2")
+	assert.False(t, ok)
+	_, ok = cache.get("b/1")
+	assert.True(t, ok)
+	assert.Equal(t, int64(len("content of b/1")), cache.size)
+
+	rc, err := load("a/1")
+	assert.NoError(t, err)
+	_, isTee := rc.(*diskTee)
+	assert.True(t, isTee)
+
+	// deleting a key while it is being loaded
+	rc, err = cache.GetOrLoad("c/1", bytesLoader([]byte("content of c/1")))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, cache.Delete("c/1"))
+	_, err = ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	_, ok = cache.get("c/1")
+	assert.False(t, ok)
+}
+
+func TestDiskCacheSharedContent(t *testing.T) {
+	content := []byte("shared content")
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-disk-test",
+		DiskSizeMax:    int64(len(content)) - 1,
+		EntrySizeMax:   int64(len(content)),
+
+		// eviction is triggered manually
+		EvictionPeriodMin:      time.Hour,
+		EvictionEmergencyRatio: 100,
+	})
+	defer cache.PurgeAndClose()
+
+	for _, key := range []string{"a", "b", "c"} {
+		rc, err := cache.GetOrLoad(key, bytesLoader(content))
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+	}
+
+	entry, _ := cache.get("a")
+	filename := cache.getFilename(entry.sum)
+	assert.Equal(t, int64(len(content)), cache.size)
+	assert.Equal(t, 3, cache.blobs[string(entry.sum)].refs)
+
+	assert.NoError(t, cache.Delete("a"))
+	assert.Equal(t, int64(len(content)), cache.size)
+	_, err := os.Stat(filename)
+	assert.NoError(t, err)
+
+	rc, err := cache.GetOrLoad("b", FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+		return 0, nil, errTestFail
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, err := ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.Equal(t, content, b)
+
+	cache.eviction()
+	assert.Equal(t, int64(0), cache.size)
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err))
+	assert.Len(t, cache.blobs, 0)
+}
+
+func TestDiskCacheRecommit(t *testing.T) {
+	content := []byte("content")
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-disk-test",
+	})
+	defer cache.PurgeAndClose()
+
+	rc, err := cache.GetOrLoad("key", bytesLoader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	entry, _ := cache.get("key")
+
+	// the key is committed again with the same content
+	tmp, err := cache.fs.CreateTemp(cache.basePath, tempPrefix)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = tmp.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, tmp.Close())
+	call := newLoadCall(context.Background())
+	defer call.cancel()
+	assert.NoError(t, cache.addFileLocked(nil, tmp.Name(), "key", call, entry, nil))
+
+	_, err = os.Stat(cache.getFilename(entry.sum))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), cache.size)
+	assert.Equal(t, 1, cache.count)
+	checkDiskCache(t, cache)
+}
+
+func TestDiskCacheContext(t *testing.T) {
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-disk-test",
+	})
+	defer cache.PurgeAndClose()
+
+	loadCtxs := make(chan context.Context, 1)
+	loader := FuncContextLoader(func(ctx context.Context, _ string) (int64, io.ReadCloser, error) {
+		loadCtxs <- ctx
+		return 4, ioutil.NopCloser(ctxReader{ctx}), nil
+	})
+
+	leaderCtx, leaderCancel := context.WithCancel(context.Background())
+	defer leaderCancel()
+	rc, err := cache.GetOrLoadContext(leaderCtx, "key", loader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	loadCtx := <-loadCtxs
+
+	// a waiter giving up does not cancel the load
+	waiterCtx, waiterCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	frc, err := cache.GetOrLoadContext(waiterCtx, "key", loader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, isFollower := frc.(*diskFollower)
+	assert.True(t, isFollower)
+	_, err = ioutil.ReadAll(frc)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.NoError(t, frc.Close())
+	assert.NoError(t, loadCtx.Err())
+	waiterCancel()
+
+	// the load is cancelled when the waiters and the leader have given up
+	waiterCtx, waiterCancel = context.WithCancel(context.Background())
+	defer waiterCancel()
+	frc, err = cache.GetOrLoadContext(waiterCtx, "key", loader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	leaderCancel()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, loadCtx.Err())
+	waiterCancel()
+	select {
+	case <-loadCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("load not cancelled")
+	}
+	_, err = ioutil.ReadAll(frc)
+	assert.Equal(t, context.Canceled, err)
+	assert.NoError(t, frc.Close())
+
+	_, err = ioutil.ReadAll(rc)
+	assert.Equal(t, context.Canceled, err)
+	assert.NoError(t, rc.Close())
+
+	_, err = cache.GetOrLoadContext(leaderCtx, "key", loader)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestDiskCacheStreaming(t *testing.T) {
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-disk-test",
+	})
+	defer cache.PurgeAndClose()
+
+	var loads int32
+	pr, pw := io.Pipe()
+	loader := FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+		atomic.AddInt32(&loads, 1)
+		return 8, pr, nil
+	})
+
+	rc, err := cache.GetOrLoad("key", loader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	frc, err := cache.GetOrLoad("key", loader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, isFollower := frc.(*diskFollower)
+	assert.True(t, isFollower)
+
+	go pw.Write([]byte("abcd"))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(rc, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abcd"), b)
+	_, err = io.ReadFull(frc, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abcd"), b)
+
+	// the leader gives up: the content is still loaded for the follower
+	assert.NoError(t, rc.Close())
+	go func() {
+		pw.Write([]byte("efgh"))
+		pw.Close()
+	}()
+	b, err = ioutil.ReadAll(frc)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("efgh"), b)
+	assert.NoError(t, frc.Close())
+
+	for i := 0; ; i++ {
+		cache.mu.Lock()
+		_, ok := cache.get("key")
+		cache.mu.Unlock()
+		if ok {
+			break
+		}
+		if i > 1000 {
+			t.Fatal("content not committed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rc, err = cache.GetOrLoad("key", loader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, isFile := rc.(*diskFile)
+	assert.True(t, isFile)
+	b, err = ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.Equal(t, []byte("abcdefgh"), b)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+}
+
+func TestDiskCacheLoadErrorPolicy(t *testing.T) {
+	const waiters = 8
+
+	tests := []struct {
+		policy LoadErrorPolicy
+		loads  int32
+	}{
+		{LoadErrorRetryEach, 1 + waiters},
+		{LoadErrorShare, 1},
+		{LoadErrorRetry, 3},
+	}
+
+	for _, test := range tests {
+		cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+			BasePath:         os.TempDir(),
+			BasePathPrefix:   "cozy-disk-test",
+			LoadErrorPolicy:  test.policy,
+			LoadRetryMax:     2,
+			LoadRetryBackoff: time.Millisecond,
+		})
+
+		var loads int32
+		gate := make(chan struct{})
+		loader := FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+			atomic.AddInt32(&loads, 1)
+			<-gate
+			return 0, nil, errTestFail
+		})
+
+		errc := make(chan error)
+		for i := 0; i < waiters+1; i++ {
+			go func() {
+				_, err := cache.GetOrLoad("key", loader)
+				errc <- err
+			}()
+		}
+		for {
+			cache.mu.Lock()
+			call, ok := cache.calls["key"]
+			joined := ok && call.refs == waiters+1
+			cache.mu.Unlock()
+			if joined {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		close(gate)
+		for i := 0; i < waiters+1; i++ {
+			assert.Equal(t, errTestFail, <-errc)
+		}
+		assert.Equal(t, test.loads, atomic.LoadInt32(&loads))
+		assert.NoError(t, cache.PurgeAndClose())
+	}
+}
+
+func TestDiskCacheNegative(t *testing.T) {
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-disk-test",
+		NegativeTTL:    50 * time.Millisecond,
+	})
+	defer cache.PurgeAndClose()
+
+	var loads int32
+	loader := FuncLoader(func(key string) (int64, io.ReadCloser, error) {
+		atomic.AddInt32(&loads, 1)
+		if key == "missing" {
+			return 0, nil, ErrNotFound
+		}
+		return 0, nil, errTestFail
+	})
+
+	for i := 0; i < 3; i++ {
+		_, err := cache.GetOrLoad("missing", loader)
+		assert.Equal(t, ErrNotFound, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+	stats := cache.Stats()
+	assert.Equal(t, 1, stats.NegativeEntries)
+	assert.Equal(t, int64(2), stats.NegativeHits)
+
+	for i := 0; i < 3; i++ {
+		_, err := cache.GetOrLoad("failing", loader)
+		assert.Equal(t, errTestFail, err)
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&loads))
+
+	assert.NoError(t, cache.Delete("missing"))
+	_, err := cache.GetOrLoad("missing", loader)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&loads))
+
+	assert.NoError(t, cache.DeleteFunc(func(key string) bool { return key == "missing" }))
+	assert.Equal(t, 0, cache.Stats().NegativeEntries)
+	_, err = cache.GetOrLoad("missing", loader)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, int32(6), atomic.LoadInt32(&loads))
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = cache.GetOrLoad("missing", loader)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, int32(7), atomic.LoadInt32(&loads))
+}
+
+func TestDiskCacheUnknownSize(t *testing.T) {
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-disk-test",
+		EntrySizeMax:   8,
+	})
+	defer cache.PurgeAndClose()
+
+	unknownSizeLoader := func(b []byte) Loader {
+		return FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+			return -1, ioutil.NopCloser(bytes.NewReader(b)), nil
+		})
+	}
+
+	for _, test := range []struct {
+		content []byte
+		cached  bool
+	}{
+		{[]byte("toto"), true},
+		{[]byte("too large"), false},
+	} {
+		key := string(test.content)
+		for i := 0; i < 2; i++ {
+			rc, err := cache.GetOrLoad(key, unknownSizeLoader(test.content))
+			if !assert.NoError(t, err) {
+				return
+			}
+			_, isFile := rc.(*diskFile)
+			assert.Equal(t, test.cached && i == 1, isFile)
+			b, err := ioutil.ReadAll(rc)
+			assert.NoError(t, err)
+			assert.NoError(t, rc.Close())
+			assert.Equal(t, test.content, b)
+		}
+	}
+	assert.Equal(t, int64(4), cache.size)
+
+	// an incomplete read of an unknown size content is not cached
+	rc, err := cache.GetOrLoad("incomplete", unknownSizeLoader([]byte("tata")))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.ReadFull(rc, make([]byte, 4))
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	_, ok := cache.get("incomplete")
+	assert.False(t, ok)
+
+	// the followers of a too large content keep on reading it
+	var loads int
+	pr, pw := io.Pipe()
+	loader := FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+		if loads++; loads == 1 {
+			return -1, pr, nil
+		}
+		return -1, ioutil.NopCloser(bytes.NewReader([]byte("too large"))), nil
+	})
+	rc, err = cache.GetOrLoad("too large", loader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	frc, err := cache.GetOrLoad("too large", loader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, isFollower := frc.(*diskFollower)
+	assert.True(t, isFollower)
+	go func() {
+		pw.Write([]byte("too "))
+		pw.Write([]byte("large"))
+		pw.Close()
+	}()
+	fb := make(chan []byte)
+	go func() {
+		b, err := ioutil.ReadAll(frc)
+		assert.NoError(t, err)
+		assert.NoError(t, frc.Close())
+		fb <- b
+	}()
+	b, err := ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.Equal(t, []byte("too large"), b)
+	assert.Equal(t, []byte("too large"), <-fb)
+	assert.Equal(t, 2, loads)
+	_, ok = cache.get("too large")
+	assert.False(t, ok)
+}
+
+func TestDiskCacheStats(t *testing.T) {
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-disk-test",
+		DiskSizeMax:    8,
+		EntrySizeMax:   8,
+
+		// eviction is triggered manually
+		EvictionPeriodMin:      time.Hour,
+		EvictionEmergencyRatio: 100,
+	})
+	defer cache.PurgeAndClose()
+
+	read := func(key string, loader Loader) error {
+		rc, err := cache.GetOrLoad(key, loader)
+		if err != nil {
+			return err
+		}
+		if _, err = ioutil.ReadAll(rc); err != nil {
+			rc.Close()
+			return err
+		}
+		return rc.Close()
+	}
+
+	assert.NoError(t, read("a", bytesLoader([]byte("aaaa"))))
+	assert.NoError(t, read("a", bytesLoader([]byte("aaaa"))))
+	assert.NoError(t, read("b", bytesLoader([]byte("bbbb"))))
+	assert.Equal(t, errTestFail, read("c", FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+		return 0, nil, errTestFail
+	})))
+
+	// a partial read of a file does not check its integrity
+	rc, err := cache.GetOrLoad("b", bytesLoader([]byte("bbbb")))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = rc.Read(make([]byte, 1))
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+
+	entry, _ := cache.get("b")
+	assert.NoError(t, ioutil.WriteFile(cache.getFilename(entry.sum), []byte("BBBB"), 0600))
+	assert.Equal(t, errCorruptedCache, read("b", bytesLoader([]byte("bbbb"))))
+
+	stats := cache.Stats()
+	assert.Equal(t, int64(3), stats.Hits)
+	assert.Equal(t, int64(3), stats.Misses)
+	assert.Equal(t, int64(1), stats.LoadErrors)
+	assert.Equal(t, int64(1), stats.Corruptions)
+	assert.Equal(t, int64(8), stats.Size)
+	assert.Equal(t, int64(8), stats.SizeMax)
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, 0, stats.InFlight)
+
+	assert.NoError(t, read("d", bytesLoader([]byte("dddd"))))
+	cache.eviction()
+	stats = cache.Stats()
+	assert.Equal(t, int64(1), stats.EvictionRuns)
+	assert.Equal(t, int64(1), stats.EvictedEntries)
+	assert.Equal(t, int64(4), stats.EvictedBytes)
+	assert.Equal(t, int64(8), stats.Size)
+	assert.Equal(t, 2, stats.Entries)
+}
+
+func TestDiskCacheObserver(t *testing.T) {
+	observer := &recordObserver{}
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-disk-test",
+		DiskSizeMax:    8,
+		EntrySizeMax:   4,
+		Observer:       observer,
+
+		// eviction is triggered manually
+		EvictionPeriodMin:      time.Hour,
+		EvictionEmergencyRatio: 100,
+	})
+	defer cache.PurgeAndClose()
+
+	read := func(key string, content string) error {
+		rc, err := cache.GetOrLoad(key, bytesLoader([]byte(content)))
+		if err != nil {
+			return err
+		}
+		if _, err = ioutil.ReadAll(rc); err != nil {
+			rc.Close()
+			return err
+		}
+		return rc.Close()
+	}
+
+	assert.NoError(t, read("a", "aaaa"))
+	assert.NoError(t, read("a", "aaaa"))
+	assert.NoError(t, read("b", "bbbbbbbb"))
+	assert.NoError(t, read("c", "cccc"))
+	assert.NoError(t, read("d", "dddd"))
+	cache.eviction()
+
+	entry, _ := cache.get("d")
+	assert.NoError(t, ioutil.WriteFile(cache.getFilename(entry.sum), []byte("DDDD"), 0600))
+	assert.Equal(t, errCorruptedCache, read("d", "dddd"))
+
+	assert.Equal(t, []string{
+		"miss a", "loadstart a", "loaddone a 4 <nil>", "commit a 4 <nil>",
+		"hit a",
+		"miss b", "loadstart b", "loaddone b 8 <nil>", "bypass b 8",
+		"miss c", "loadstart c", "loaddone c 4 <nil>", "commit c 4 <nil>",
+		"miss d", "loadstart d", "loaddone d 4 <nil>", "commit d 4 <nil>",
+		"evict a 4",
+		"hit d", "corruption d",
+	}, observer.events)
+}
+
 func TestRandomWithSuccessOnly(t *testing.T) {
 	const workerOps = 1024
 	const concurrency = 256
@@ -382,9 +1273,46 @@ func (r *resourceHandler) Close() error {
 	return nil
 }
 
+func bytesLoader(b []byte) Loader {
+	return FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+		return int64(len(b)), ioutil.NopCloser(bytes.NewReader(b)), nil
+	})
+}
+
 var errTestFail = errors.New("failure")
 var errWantedErr = errors.New("wanted")
 
+type recordObserver struct {
+	NopObserver
+	events []string
+}
+
+func (o *recordObserver) record(format string, a ...interface{}) {
+	o.events = append(o.events, fmt.Sprintf(format, a...))
+}
+
+func (o *recordObserver) OnHit(_ context.Context, key string)  { o.record("hit %s", key) }
+func (o *recordObserver) OnMiss(_ context.Context, key string) { o.record("miss %s", key) }
+func (o *recordObserver) OnBypass(_ context.Context, key string, size int64) {
+	o.record("bypass %s %d", key, size)
+}
+func (o *recordObserver) OnLoadStart(_ context.Context, key string) { o.record("loadstart %s", key) }
+func (o *recordObserver) OnLoadDone(_ context.Context, key string, size int64, err error, _ time.Duration) {
+	o.record("loaddone %s %d %v", key, size, err)
+}
+func (o *recordObserver) OnCommit(_ context.Context, key string, size int64, err error, _ time.Duration) {
+	o.record("commit %s %d %v", key, size, err)
+}
+func (o *recordObserver) OnEvict(key string, size int64) { o.record("evict %s %d", key, size) }
+func (o *recordObserver) OnCorruption(key string)        { o.record("corruption %s", key) }
+
+type ctxReader struct{ ctx context.Context }
+
+func (r ctxReader) Read(p []byte) (n int, err error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
 type failReader struct{}
 
 func (f failReader) Read(p []byte) (n int, err error) { return 0, errTestFail }
@@ -0,0 +1,521 @@
+package immcache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errCrashed = errors.New("crashed")
+
+// faultStorage wraps a Storage to inject faults into its operations. Each
+// operation, including the writes and syncs of the opened files, is counted.
+// The machine is considered crashed after crashAt operations: all the next
+// operations fail, and the content written to the files of a MemStorage since
+// their last sync is lost, as with a power loss. The lost bytes are zeroed,
+// like on a filesystem persisting the size of a file before its content.
+type faultStorage struct {
+	Storage
+
+	mu      sync.Mutex
+	ops     int
+	crashAt int // 0 to never crash
+	crashed bool
+
+	// synced length of the files written since their last sync, owned by mu
+	unsynced map[*memNode]int
+
+	// inject returns the error to inject into the given operation, if any.
+	// owned by mu
+	inject func(op, name string) error
+}
+
+func (s *faultStorage) fault(op, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.crashed {
+		return errCrashed
+	}
+	s.ops++
+	if s.crashAt > 0 && s.ops >= s.crashAt {
+		s.crashLocked()
+		return errCrashed
+	}
+	if s.inject != nil {
+		if err := s.inject(op, name); err != nil {
+			return &os.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+	return nil
+}
+
+// crash crashes the machine, if not already crashed.
+func (s *faultStorage) crash() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.crashed {
+		s.crashLocked()
+	}
+}
+
+func (s *faultStorage) crashLocked() {
+	s.crashed = true
+	for n, l := range s.unsynced {
+		n.mu.Lock()
+		for i := l; i < len(n.data); i++ {
+			n.data[i] = 0
+		}
+		n.mu.Unlock()
+	}
+	s.unsynced = nil
+}
+
+// randomFaults returns an inject function failing the given operations with
+// the given probability.
+func randomFaults(seed int64, p float64, errs map[string]error) func(op, name string) error {
+	rng := rand.New(rand.NewSource(seed))
+	return func(op, name string) error {
+		if err, ok := errs[op]; ok && rng.Float64() < p {
+			return err
+		}
+		return nil
+	}
+}
+
+func (s *faultStorage) MkdirAll(path string) error {
+	if err := s.fault("mkdir", path); err != nil {
+		return err
+	}
+	return s.Storage.MkdirAll(path)
+}
+
+func (s *faultStorage) TempDir(dir, prefix string) (string, error) {
+	if err := s.fault("mkdir", dir); err != nil {
+		return "", err
+	}
+	return s.Storage.TempDir(dir, prefix)
+}
+
+func (s *faultStorage) ReadDir(dirname string) ([]os.FileInfo, error) {
+	if err := s.fault("readdir", dirname); err != nil {
+		return nil, err
+	}
+	return s.Storage.ReadDir(dirname)
+}
+
+func (s *faultStorage) Stat(name string) (os.FileInfo, error) {
+	if err := s.fault("stat", name); err != nil {
+		return nil, err
+	}
+	return s.Storage.Stat(name)
+}
+
+func (s *faultStorage) Open(name string) (File, error) {
+	if err := s.fault("open", name); err != nil {
+		return nil, err
+	}
+	f, err := s.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{f, s}, nil
+}
+
+func (s *faultStorage) OpenAppend(name string) (File, error) {
+	if err := s.fault("create", name); err != nil {
+		return nil, err
+	}
+	f, err := s.Storage.OpenAppend(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{f, s}, nil
+}
+
+func (s *faultStorage) CreateTemp(dir, prefix string) (File, error) {
+	if err := s.fault("create", dir); err != nil {
+		return nil, err
+	}
+	f, err := s.Storage.CreateTemp(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{f, s}, nil
+}
+
+func (s *faultStorage) Rename(oldpath, newpath string) error {
+	if err := s.fault("rename", newpath); err != nil {
+		return err
+	}
+	return s.Storage.Rename(oldpath, newpath)
+}
+
+func (s *faultStorage) RenameExclusive(oldpath, newpath string) error {
+	if err := s.fault("rename", newpath); err != nil {
+		return err
+	}
+	return s.Storage.RenameExclusive(oldpath, newpath)
+}
+
+func (s *faultStorage) Remove(name string) error {
+	if err := s.fault("remove", name); err != nil {
+		return err
+	}
+	return s.Storage.Remove(name)
+}
+
+func (s *faultStorage) RemoveAll(path string) error {
+	if err := s.fault("remove", path); err != nil {
+		return err
+	}
+	return s.Storage.RemoveAll(path)
+}
+
+type faultFile struct {
+	File
+	s *faultStorage
+}
+
+// written records the synced length of the file before it is written.
+func (s *faultStorage) written(f File) {
+	mf, ok := f.(*memFile)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.unsynced[mf.n]; ok || s.crashed {
+		return
+	}
+	if s.unsynced == nil {
+		s.unsynced = make(map[*memNode]int)
+	}
+	mf.n.mu.RLock()
+	s.unsynced[mf.n] = len(mf.n.data)
+	mf.n.mu.RUnlock()
+}
+
+// synced forgets the unsynced writes of the file.
+func (s *faultStorage) synced(f File) {
+	if mf, ok := f.(*memFile); ok {
+		s.mu.Lock()
+		delete(s.unsynced, mf.n)
+		s.mu.Unlock()
+	}
+}
+
+// Write writes half of the given bytes when a fault is injected, like a disk
+// getting full.
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.s.written(f.File)
+	if err := f.s.fault("write", f.Name()); err != nil {
+		if err == errCrashed {
+			return 0, err
+		}
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.s.fault("sync", f.Name()); err != nil {
+		return err
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	f.s.synced(f.File)
+	return nil
+}
+
+// checkDiskCache asserts the invariants of a cache against the content of its
+// storage: the entries of the index point at valid files, and the size of the
+// cache is the size of the files stored in it.
+func checkDiskCache(t *testing.T, c *DiskCache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count := 0
+	c.index.Range(func(key string, value interface{}) bool {
+		entry := value.(diskEntry)
+		count++
+		filename := c.getFilename(entry.sum)
+		if fi, err := c.fs.Stat(filename); assert.NoError(t, err, key) {
+			assert.Equal(t, entry.size, fi.Size(), key)
+		}
+		if sum, err := c.sumFile(filename); assert.NoError(t, err, key) {
+			assert.Equal(t, entry.sum, sum, key)
+		}
+		return true
+	})
+	assert.Equal(t, count, c.count)
+
+	var size int64
+	dirs, err := c.fs.ReadDir(c.basePath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := c.fs.ReadDir(filepath.Join(c.basePath, dir.Name()))
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, file := range files {
+			size += file.Size()
+		}
+	}
+	assert.Equal(t, size, c.size)
+}
+
+// checkNoTempFiles asserts that the base directory of a cache only contains
+// its journal and the directories of its files.
+func checkNoTempFiles(t *testing.T, fs Storage, basePath string) {
+	dirs, err := fs.ReadDir(basePath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			assert.Equal(t, journalFilename, dir.Name())
+		}
+	}
+}
+
+// faultContent returns the content of the given key of the fault tests. Some
+// keys share the same content.
+func faultContent(key string) []byte {
+	i, _ := strconv.Atoi(key)
+	rng := rand.New(rand.NewSource(int64(i % 48)))
+	b := make([]byte, rng.Intn(2048)+1)
+	rng.Read(b)
+	return b
+}
+
+func faultLoader(key string) (int64, io.ReadCloser, error) {
+	b := faultContent(key)
+	return int64(len(b)), ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func TestDiskCacheCrash(t *testing.T) {
+	workload := func(c *DiskCache) {
+		for _, key := range []string{"1", "2", "3", "49", "4", "1", "5", "6", "7"} {
+			if rc, err := c.GetOrLoad(key, FuncLoader(faultLoader)); err == nil {
+				ioutil.ReadAll(rc)
+				rc.Close()
+			}
+			if key == "4" {
+				c.Delete("2")
+			}
+		}
+		c.eviction()
+		c.Close()
+	}
+
+	for _, persist := range []bool{false, true} {
+		opts := DiskCacheOptions{
+			BasePath:     "/cache",
+			HashMode:     HashUnkeyed,
+			DiskSizeMax:  4096,
+			EntrySizeMax: 2048,
+			PersistIndex: persist,
+
+			// eviction is triggered manually
+			EvictionPeriodMin:      time.Hour,
+			EvictionEmergencyRatio: 100,
+		}
+
+		// count the operations of the workload to crash at each of them
+		fs := &faultStorage{Storage: NewMemStorage()}
+		opts.Storage = fs
+		workload(NewDiskCache(LRUIndex(), opts))
+		ops := fs.ops
+
+		for crashAt := 1; crashAt <= ops+1; crashAt++ {
+			mem := NewMemStorage()
+			fs := &faultStorage{Storage: mem, crashAt: crashAt}
+			opts.Storage = fs
+			workload(NewDiskCache(LRUIndex(), opts))
+			// the power is lost after the workload if it did not crash
+			fs.crash()
+
+			opts.Storage = mem
+			cache := NewDiskCache(LRUIndex(), opts)
+			if !assert.True(t, cache.init()) {
+				return
+			}
+			<-cache.verified
+			checkDiskCache(t, cache)
+			checkNoTempFiles(t, mem, opts.BasePath)
+			cache.PurgeAndClose()
+			if t.Failed() {
+				t.Logf("persist=%t crashAt=%d/%d", persist, crashAt, ops)
+				return
+			}
+		}
+	}
+}
+
+func TestDiskCacheFollowerWriteError(t *testing.T) {
+	fs := &faultStorage{Storage: NewMemStorage()}
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       "/cache",
+		BasePathPrefix: "test",
+		Storage:        fs,
+	})
+	defer cache.PurgeAndClose()
+
+	var loads int
+	pr, pw := io.Pipe()
+	loader := FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+		if loads++; loads == 1 {
+			return 8, pr, nil
+		}
+		return 8, ioutil.NopCloser(bytes.NewReader([]byte("abcdefgh"))), nil
+	})
+
+	rc, err := cache.GetOrLoad("key", loader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	frc, err := cache.GetOrLoad("key", loader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	go pw.Write([]byte("abcd"))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(rc, b)
+	assert.NoError(t, err)
+	_, err = io.ReadFull(frc, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abcd"), b)
+
+	// the disk gets full: the follower loads the rest of the content
+	fs.mu.Lock()
+	fs.inject = func(op, _ string) error {
+		if op == "write" {
+			return syscall.ENOSPC
+		}
+		return nil
+	}
+	fs.mu.Unlock()
+	go func() {
+		pw.Write([]byte("efgh"))
+		pw.Close()
+	}()
+	b, err = ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("efgh"), b)
+	b, err = ioutil.ReadAll(frc)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("efgh"), b)
+	assert.NoError(t, frc.Close())
+	assert.NoError(t, rc.Close())
+	assert.Equal(t, 2, loads)
+
+	cache.mu.Lock()
+	_, ok := cache.get("key")
+	cache.mu.Unlock()
+	assert.False(t, ok)
+}
+
+func TestRandomWithFaults(t *testing.T) {
+	const workerOps = 256
+	const concurrency = 64
+	const keysLen = 64
+
+	seed := time.Now().UnixNano()
+	mem := NewMemStorage()
+	fs := &faultStorage{
+		Storage: mem,
+		inject: randomFaults(seed, 0.02, map[string]error{
+			"create": syscall.ENOSPC,
+			"write":  syscall.ENOSPC,
+			"sync":   syscall.EIO,
+			"rename": syscall.EIO,
+			"remove": syscall.EIO,
+		}),
+	}
+	opts := DiskCacheOptions{
+		BasePath:     "/cache",
+		HashMode:     HashUnkeyed,
+		DiskSizeMax:  32 * 1024,
+		EntrySizeMax: 2048,
+		PersistIndex: true,
+		Storage:      fs,
+	}
+	cache := NewDiskCache(LRUIndex(), opts)
+
+	donech := make(chan error)
+	for i := 0; i < concurrency; i++ {
+		go func(r *rand.Rand) {
+			for j := 0; j < workerOps; j++ {
+				key := strconv.Itoa(r.Intn(keysLen))
+				if r.Intn(50) == 0 {
+					cache.Delete(key)
+					continue
+				}
+				rc, err := cache.GetOrLoad(key, FuncLoader(faultLoader))
+				if err != nil {
+					donech <- err
+					return
+				}
+				b, err := ioutil.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					donech <- err
+					return
+				}
+				if !bytes.Equal(faultContent(key), b) {
+					donech <- errors.New("content mismatch for key " + key)
+					return
+				}
+			}
+			donech <- nil
+		}(rand.New(rand.NewSource(seed + int64(i))))
+	}
+	for i := 0; i < concurrency; i++ {
+		assert.NoError(t, <-donech)
+	}
+
+	// wait for the commits of the last loads
+	for {
+		cache.mu.Lock()
+		inflight := len(cache.calls)
+		cache.mu.Unlock()
+		if inflight == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	checkDiskCache(t, cache)
+	cache.Close()
+	// the power is lost after the closing of the cache
+	fs.crash()
+
+	opts.Storage = mem
+	cache = NewDiskCache(LRUIndex(), opts)
+	defer cache.PurgeAndClose()
+	if !assert.True(t, cache.init()) {
+		return
+	}
+	<-cache.verified
+	checkDiskCache(t, cache)
+	checkNoTempFiles(t, mem, opts.BasePath)
+	if t.Failed() {
+		t.Logf("seed=%d", seed)
+	}
+}
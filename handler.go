@@ -0,0 +1,247 @@
+package immcache
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defaultHandlerMaxAge = 365 * 24 * time.Hour
+
+// Handler serves the contents of a DiskCache over HTTP, for instance to serve
+// versioned assets. Since the contents are immutable, the responses can be
+// cached forever by the clients: they are served with a strong ETag derived
+// from the sum of the content when it is read from the disk, and with an
+// immutable Cache-Control. The range requests are supported for the contents
+// read from the disk, the other ones being served entirely.
+//
+// When the loader is a MetadataLoader, the content type and last modification
+// time of its metadata are used for the responses.
+//
+// Only the GET and HEAD methods are allowed, a HEAD request of a missing
+// content loading it into the cache. The loader errors are served
+// with a 404 status for ErrNotFound, and a 502 status otherwise. An error
+// while streaming the content, like a corrupted file, aborts the response.
+type Handler struct {
+	cache        *DiskCache
+	loader       MetadataLoader
+	key          func(r *http.Request) string
+	contentType  func(key string) string
+	cacheControl string
+}
+
+// HandlerOptions are the options to create a handler.
+type HandlerOptions struct {
+	// Loader is called to load the contents missing from the cache. If it
+	// implements MetadataLoader, the metadata of the contents are stored with
+	// them.
+	Loader ContextLoader
+
+	// Key returns the key of the content requested, by default the path of
+	// the request without its leading slash. An empty key is not found.
+	Key func(r *http.Request) string
+
+	// ContentType returns the content type of the given key, by default
+	// deduced from the extension of the key.
+	ContentType func(key string) string
+
+	// MaxAge is the duration for which the clients can cache the responses, by
+	// default one year.
+	MaxAge time.Duration
+}
+
+// NewHandler returns a handler serving the contents of the given cache.
+func NewHandler(cache *DiskCache, opts HandlerOptions) *Handler {
+	h := &Handler{
+		cache:       cache,
+		key:         opts.Key,
+		contentType: opts.ContentType,
+	}
+	if loader, ok := opts.Loader.(MetadataLoader); ok {
+		h.loader = loader
+	} else {
+		h.loader = metadataLoader{opts.Loader}
+	}
+	if h.key == nil {
+		h.key = func(r *http.Request) string {
+			return strings.TrimPrefix(r.URL.Path, "/")
+		}
+	}
+	if h.contentType == nil {
+		h.contentType = func(key string) string {
+			return mime.TypeByExtension(path.Ext(key))
+		}
+	}
+	maxAge := opts.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultHandlerMaxAge
+	}
+	h.cacheControl = "public, max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10) + ", immutable"
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := h.key(r)
+	if key == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// a revalidation of a cached entry does not need to open its file.
+	inm := r.Header.Get("If-None-Match")
+	if inm != "" {
+		if entry, ok := h.cache.lookup(key); ok && etagMatch(inm, etagOf(entry.sum)) {
+			h.setHeaders(w, key, etagOf(entry.sum), -1, decodeMetadata(entry.meta))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	// the cached contents are served with the support of the range and
+	// conditional requests.
+	if rs, err := h.cache.OpenSeeker(r.Context(), key); err == nil {
+		defer rs.Close()
+		s := rs.(*diskSeeker)
+		meta := decodeMetadata(s.meta)
+		h.setHeaders(w, key, etagOf(s.sum), -1, meta)
+		var modtime time.Time
+		if meta != nil {
+			modtime = meta.LastModified
+		}
+		http.ServeContent(w, r, "", modtime, rs)
+		return
+	}
+
+	rc, meta, err := h.cache.GetOrLoadMetadata(r.Context(), key, h.loader)
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		var etag string
+		size := int64(-1)
+		switch f := rc.(type) {
+		case *diskTee:
+			// the content is drained to be committed into the cache, rather
+			// than loaded for nothing.
+			n, err := io.Copy(ioutil.Discard, rc)
+			if errc := rc.Close(); err == nil {
+				err = errc
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			size = n
+			if entry, ok := h.cache.lookup(key); ok {
+				etag = etagOf(entry.sum)
+			}
+		case *diskFile:
+			etag, size = etagOf(f.sum), f.size
+			rc.Close()
+		default:
+			// the content is not cached, like a too large one.
+			rc.Close()
+		}
+		h.setHeaders(w, key, etag, size, meta)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// the sum of the content is only known when it is read from the disk.
+	var etag string
+	size := int64(-1)
+	switch f := rc.(type) {
+	case *diskFile:
+		etag, size = etagOf(f.sum), f.size
+	case *diskTee:
+		size = f.size
+	}
+
+	if etag != "" && inm != "" && etagMatch(inm, etag) {
+		rc.Close()
+		h.setHeaders(w, key, etag, -1, meta)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.setHeaders(w, key, etag, size, meta)
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, rc)
+	if errc := rc.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		// the status has already been sent: the connection is closed so that
+		// the client does not get an incomplete or corrupted content.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (h *Handler) setHeaders(w http.ResponseWriter, key, etag string, size int64, meta *Metadata) {
+	header := w.Header()
+	header.Set("Cache-Control", h.cacheControl)
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	if size >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	var contentType string
+	if meta != nil {
+		contentType = meta.ContentType
+		if !meta.LastModified.IsZero() {
+			header.Set("Last-Modified", meta.LastModified.UTC().Format(http.TimeFormat))
+		}
+	}
+	if contentType == "" {
+		contentType = h.contentType(key)
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+}
+
+// lookup returns the entry of the given key, if cached.
+func (c *DiskCache) lookup(key string) (entry diskEntry, ok bool) {
+	if atomic.LoadUint32(&c.state) != inited {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(key)
+}
+
+func etagOf(sum []byte) string {
+	return `"` + hex.EncodeToString(sum) + `"`
+}
+
+// etagMatch returns whether the given If-None-Match header matches the etag,
+// using the weak comparison.
+func etagMatch(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package immcache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-handler-test",
+		DiskSizeMax:    1 << 20,
+	})
+	defer cache.PurgeAndClose()
+
+	var loads int
+	handler := NewHandler(cache, HandlerOptions{
+		Loader: FuncContextLoader(func(_ context.Context, key string) (int64, io.ReadCloser, error) {
+			loads++
+			if key == "large.bin" {
+				return 1 << 20, failReader{}, nil
+			}
+			if key != "app.123.js" && key != "head.js" {
+				return 0, nil, ErrNotFound
+			}
+			return 7, ioutil.NopCloser(bytes.NewReader([]byte("alert()"))), nil
+		}),
+	})
+
+	serve := func(method, path, inm string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if inm != "" {
+			r.Header.Set("If-None-Match", inm)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// the first response is streamed while being loaded, without ETag
+	w := serve("GET", "/app.123.js", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alert()", w.Body.String())
+	assert.Equal(t, "7", w.Header().Get("Content-Length"))
+	assert.Equal(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+	assert.Contains(t, w.Header().Get("Content-Type"), "javascript")
+	assert.Empty(t, w.Header().Get("ETag"))
+
+	w = serve("GET", "/app.123.js", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alert()", w.Body.String())
+	etag := w.Header().Get("ETag")
+	entry, _ := cache.lookup("app.123.js")
+	assert.Equal(t, etagOf(entry.sum), etag)
+
+	w = serve("HEAD", "/app.123.js", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "7", w.Header().Get("Content-Length"))
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+	assert.Empty(t, w.Body.String())
+
+	for _, inm := range []string{etag, `"other", W/` + etag, "*"} {
+		w = serve("GET", "/app.123.js", inm)
+		assert.Equal(t, http.StatusNotModified, w.Code, inm)
+		assert.Equal(t, etag, w.Header().Get("ETag"))
+		assert.Empty(t, w.Body.String())
+	}
+	w = serve("GET", "/app.123.js", `"other"`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, loads)
+
+	// a HEAD request on a missing content commits it into the cache
+	w = serve("HEAD", "/head.js", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "7", w.Header().Get("Content-Length"))
+	assert.Empty(t, w.Body.String())
+	headEntry, ok := cache.lookup("head.js")
+	if assert.True(t, ok) {
+		assert.Equal(t, etagOf(headEntry.sum), w.Header().Get("ETag"))
+	}
+	w = serve("GET", "/head.js", "")
+	assert.Equal(t, "alert()", w.Body.String())
+	assert.Equal(t, 2, loads)
+
+	// but a content too large to be cached is not read
+	w = serve("HEAD", "/large.bin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Length"))
+	assert.Equal(t, 3, loads)
+
+	r := httptest.NewRequest("GET", "/app.123.js", nil)
+	r.Header.Set("Range", "bytes=2-4")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "bytes 2-4/7", w.Header().Get("Content-Range"))
+	assert.Equal(t, "ert", w.Body.String())
+
+	w = serve("GET", "/missing.js", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serve("POST", "/app.123.js", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	// a corrupted content aborts the response
+	assert.NoError(t, ioutil.WriteFile(cache.getFilename(entry.sum), []byte("ALERT()"), 0600))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	res, err := http.Get(server.URL + "/app.123.js")
+	if err == nil {
+		_, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	assert.Error(t, err)
+}
@@ -1,37 +1,83 @@
 package immcache
 
-import "io"
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound can be returned by a loader when the resource does not exist. It
+// is the default error cached by the negative caching of DiskCache.
+var ErrNotFound = errors.New("immcache: not found")
 
 // Immutable defines an interface for a simple immutable key/value cache that
 // can define a load function to actually load the resource when the key
 // returns a cache-miss.
 //
+// The Delete method can be used to invalidate the entry of a key, for instance
+// when it is known that its content was wrongly published.
+//
 // The PurgeAncClose method can be used to purge the underlying cache, cleaning
 // all the cache resources. The cache is then closed, and can not be used
 // anymore.
 type Immutable interface {
 	GetOrLoad(key string, loader Loader) (io.ReadCloser, error)
+	Delete(key string) error
 	PurgeAndClose() error
 }
 
 // Loader is a function called to load the fetched resource, in the case of a
-// cache-miss. It should return the size of the content.
+// cache-miss. It should return the size of the content, or a negative value if
+// the size is unknown.
 type Loader interface {
 	Load(key string) (int64, io.ReadCloser, error)
 }
 
 // Index defines an index to store the key/value mapping.
 // RemoveUnused can be used for the eviction process to preferably remove
-// the least important entry.
+// the least important entry. Range calls the given function for each entry
+// until it returns false, and should not alter the order of the entries.
 type Index interface {
 	Get(key string) (val interface{}, ok bool)
 	Set(key string, val interface{})
+	Remove(key string) (val interface{}, ok bool)
 	RemoveUnused() (key string, value interface{}, ok bool)
+	Range(fn func(key string, val interface{}) bool)
 }
 
+// ContextLoader is a Loader receiving the context of the load. The context is
+// cancelled when none of the callers are interested in the content anymore.
+type ContextLoader interface {
+	LoadContext(ctx context.Context, key string) (int64, io.ReadCloser, error)
+}
+
+// LoadErrorPolicy defines how the callers waiting for an in-flight load of a
+// key are handled when the loader fails.
+type LoadErrorPolicy int
+
+const (
+	// LoadErrorRetryEach makes each waiting caller call the loader on its own,
+	// without populating the cache.
+	LoadErrorRetryEach LoadErrorPolicy = iota
+	// LoadErrorShare returns the error of the failed load to the waiting
+	// callers.
+	LoadErrorShare
+	// LoadErrorRetry retries the load on behalf of the waiting callers, as a
+	// new in-flight load, up to a bounded number of attempts.
+	LoadErrorRetry
+)
+
 // FuncLoader can be used to turn a loader function into a Loader.
 type FuncLoader func(key string) (int64, io.ReadCloser, error)
 
 func (f FuncLoader) Load(key string) (int64, io.ReadCloser, error) {
 	return f(key)
 }
+
+// FuncContextLoader can be used to turn a loader function into a
+// ContextLoader.
+type FuncContextLoader func(ctx context.Context, key string) (int64, io.ReadCloser, error)
+
+func (f FuncContextLoader) LoadContext(ctx context.Context, key string) (int64, io.ReadCloser, error) {
+	return f(ctx, key)
+}
@@ -55,4 +55,26 @@ func (c *LRU) RemoveUnused() (key string, value interface{}, ok bool) {
 	return
 }
 
+// Remove removes the provided key from the cache and returns its value.
+// The ok result will be true if the item was found.
+func (c *LRU) Remove(key string) (value interface{}, ok bool) {
+	if e, ok := c.m[key]; ok {
+		c.l.Remove(e)
+		delete(c.m, key)
+		return e.Value.(*lruEntry).v, true
+	}
+	return
+}
+
+// Range calls fn for each item of the cache, from the most recently used to
+// the least recently used, until fn returns false.
+func (c *LRU) Range(fn func(key string, value interface{}) bool) {
+	for e := c.l.Front(); e != nil; e = e.Next() {
+		ent := e.Value.(*lruEntry)
+		if !fn(ent.k, ent.v) {
+			return
+		}
+	}
+}
+
 var _ Index = &LRU{}
@@ -0,0 +1,253 @@
+package immcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	journalFilename   = "journal"
+	journalCompactMin = 1024
+)
+
+// journal records the operations made on the index of a DiskCache into an
+// append-only file stored in its base directory, so that the index can be
+// replayed when the cache is re-opened after a restart.
+//
+// Each record is written on its own line, the first one identifying the key
+// of the sums of the entries:
+//
+//	k <hexkeyid>                                              key of the sums
+//	s <hexsum> <size> <quoted key>                            entry set
+//	S <hexsum> <size> <hexmetasum> <b64meta> <quoted key>     entry set with metadata
+//	g <quoted key>                                            entry hit
+//	d <quoted key>                                            entry removed
+//
+// Records that cannot be parsed, typically a partially written last line after
+// a crash, are ignored on replay.
+type journal struct {
+	fs       Storage
+	keyID    []byte
+	filename string
+	f        File
+	w        *bufio.Writer
+	n        int // number of records written since the last compaction
+	next     int // number of records at which point a compaction is run
+}
+
+func openJournal(fs Storage, filename string, keyID []byte, live int) (*journal, error) {
+	f, err := fs.OpenAppend(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{
+		fs:       fs,
+		keyID:    keyID,
+		filename: filename,
+		f:        f,
+		w:        bufio.NewWriter(f),
+		n:        live,
+		next:     2*live + journalCompactMin,
+	}, nil
+}
+
+func (j *journal) set(key string, entry diskEntry) error {
+	j.write('s', key, &entry)
+	return j.commit()
+}
+
+// hit records a hit of the given key. Since the hits only update the order of
+// usage of the entries, they do not need to be durable: their records are
+// buffered until the next commit or the closing of the journal, so that a hit
+// does not cost a write.
+func (j *journal) hit(key string) {
+	j.write('g', key, nil)
+	j.n++
+}
+
+func (j *journal) remove(key string) error {
+	j.write('d', key, nil)
+	return j.commit()
+}
+
+func (j *journal) write(op byte, key string, entry *diskEntry) {
+	if entry != nil && entry.meta != nil {
+		op = 'S'
+	}
+	j.w.WriteByte(op)
+	j.w.WriteByte(' ')
+	if entry != nil {
+		j.w.WriteString(hex.EncodeToString(entry.sum))
+		j.w.WriteByte(' ')
+		j.w.WriteString(strconv.FormatInt(entry.size, 10))
+		j.w.WriteByte(' ')
+	}
+	if op == 'S' {
+		j.w.WriteString(hex.EncodeToString(entry.metaSum))
+		j.w.WriteByte(' ')
+		j.w.WriteString(base64.RawStdEncoding.EncodeToString(entry.meta))
+		j.w.WriteByte(' ')
+	}
+	j.w.WriteString(strconv.Quote(key))
+	j.w.WriteByte('\n')
+}
+
+// commit flushes the written records to the file and triggers a compaction of
+// the journal when it has grown too large compared to the number of entries.
+func (j *journal) commit() error {
+	if err := j.w.Flush(); err != nil {
+		return err
+	}
+	j.n++
+	if j.n >= j.next {
+		return j.compact()
+	}
+	return nil
+}
+
+// compact rewrites the journal with only the records necessary to rebuild the
+// current state of the index.
+func (j *journal) compact() error {
+	if err := j.close(); err != nil {
+		return err
+	}
+	entries, _, err := replayJournal(j.fs, j.filename)
+	if err != nil {
+		return err
+	}
+	if err = writeJournal(j.fs, j.filename, j.keyID, entries); err != nil {
+		return err
+	}
+	nj, err := openJournal(j.fs, j.filename, j.keyID, entries.l.Len())
+	if err != nil {
+		return err
+	}
+	*j = *nj
+	return nil
+}
+
+func (j *journal) close() error {
+	err := j.w.Flush()
+	if errs := j.f.Sync(); err == nil {
+		err = errs
+	}
+	if errc := j.f.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+// replayJournal reads the journal file and returns the resulting entries in
+// an LRU, preserving the order of usage, and the identifier of the key of
+// their sums.
+func replayJournal(fs Storage, filename string) (entries *LRU, keyID []byte, err error) {
+	entries = LRUIndex()
+	f, err := fs.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// a last line without newline was not completely written
+			return entries, keyID, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		line = line[:len(line)-1]
+		if len(line) < 2 || line[1] != ' ' {
+			continue
+		}
+		op, line := line[0], line[2:]
+		switch op {
+		case 'k':
+			if id, errd := hex.DecodeString(string(line)); errd == nil {
+				keyID = id
+			}
+		case 's', 'S':
+			n := 3
+			if op == 'S' {
+				n = 5
+			}
+			fields := bytes.SplitN(line, []byte(" "), n)
+			if len(fields) != n {
+				continue
+			}
+			sum, errd := hex.DecodeString(string(fields[0]))
+			if errd != nil || len(sum) == 0 {
+				continue
+			}
+			size, errp := strconv.ParseInt(string(fields[1]), 10, 64)
+			if errp != nil || size < 0 {
+				continue
+			}
+			entry := diskEntry{sum: sum, size: size}
+			if op == 'S' {
+				entry.metaSum, errd = hex.DecodeString(string(fields[2]))
+				if errd != nil {
+					continue
+				}
+				entry.meta, errd = base64.RawStdEncoding.DecodeString(string(fields[3]))
+				if errd != nil || entry.meta == nil {
+					continue
+				}
+			}
+			if key, ok := unquoteKey(fields[n-1]); ok {
+				entries.Set(key, entry)
+			}
+		case 'g':
+			if key, ok := unquoteKey(line); ok {
+				entries.Get(key)
+			}
+		case 'd':
+			if key, ok := unquoteKey(line); ok {
+				entries.Remove(key)
+			}
+		}
+	}
+}
+
+func unquoteKey(b []byte) (string, bool) {
+	key, err := strconv.Unquote(string(b))
+	return key, err == nil
+}
+
+// writeJournal atomically replaces the journal file with the identifier of the
+// key of the sums and set records for the given entries, from the least to the
+// most recently used.
+func writeJournal(fs Storage, filename string, keyID []byte, entries *LRU) (err error) {
+	tmp, err := fs.CreateTemp(filepath.Dir(filename), tempPrefix)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			fs.Remove(tmp.Name())
+		}
+	}()
+	j := &journal{
+		fs:       fs,
+		keyID:    keyID,
+		filename: filename,
+		f:        tmp,
+		w:        bufio.NewWriter(tmp),
+	}
+	j.w.WriteString("k " + hex.EncodeToString(keyID) + "\n")
+	for e := entries.l.Back(); e != nil; e = e.Prev() {
+		ent := e.Value.(*lruEntry)
+		entry := ent.v.(diskEntry)
+		j.write('s', ent.k, &entry)
+	}
+	if err = j.close(); err != nil {
+		return
+	}
+	return fs.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,261 @@
+package immcache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// memPreallocMax caps the buffer preallocated for the content of a known size
+// when the size of the entries is not limited: the size reported by a loader
+// must not allocate more memory than the data actually read.
+const memPreallocMax = 1 << 20
+
+// MemoryCache implements an immutable cache keeping the contents of its
+// entries in memory, within a budget of bytes. It is well suited for small and
+// hot contents, for instance as the first tier of a Tiered cache in front of a
+// DiskCache, and for the environments without a writable filesystem.
+//
+// Like a DiskCache, concurrent calls on the same key share a single in-flight
+// load: the waiting callers are served from memory once the content has been
+// read entirely by the caller that started the load.
+type MemoryCache struct {
+	index  Index                // owned by mu
+	size   int64                // owned by mu
+	calls  map[string]*loadCall // owned by mu
+	closed bool                 // owned by mu
+	mu     sync.Mutex           // not a RWMutex: indexes may have write ops on read
+
+	// "constants" after creation
+	sizeMax  int64
+	entryMax int64
+}
+
+// MemoryCacheOptions are the options to create a memory cache.
+type MemoryCacheOptions struct {
+	// SizeMax is the budget of bytes of the contents kept in memory. The least
+	// important entries of the index are evicted to stay within this budget.
+	SizeMax int64
+
+	// EntrySizeMax is the maximum size of an entry, by default a tenth of
+	// SizeMax. Larger contents are returned without being cached.
+	EntrySizeMax int64
+}
+
+// NewMemoryCache returns a Immutable keeping the cached contents in memory.
+func NewMemoryCache(index Index, opts MemoryCacheOptions) *MemoryCache {
+	entryMax := opts.EntrySizeMax
+	if entryMax <= 0 && opts.SizeMax > 0 {
+		entryMax = opts.SizeMax / 10
+	}
+	return &MemoryCache{
+		index:    index,
+		calls:    make(map[string]*loadCall),
+		sizeMax:  opts.SizeMax,
+		entryMax: entryMax,
+	}
+}
+
+func (c *MemoryCache) GetOrLoad(key string, loader Loader) (io.ReadCloser, error) {
+	return c.GetOrLoadContext(context.Background(), key, contextLoader{loader})
+}
+
+// GetOrLoadContext is like GetOrLoad but the given context can be used to give
+// up waiting for an in-flight load of the same key, with the same semantics as
+// DiskCache.GetOrLoadContext.
+func (c *MemoryCache) GetOrLoadContext(ctx context.Context, key string, loader ContextLoader) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	b, ok := c.get(key)
+	if ok || c.closed {
+		c.mu.Unlock()
+		if ok {
+			return ioutil.NopCloser(bytes.NewReader(b)), nil
+		}
+		_, src, err := loader.LoadContext(ctx, key)
+		return src, err
+	}
+	call, callHit := c.calls[key]
+	if !callHit {
+		call = newLoadCall(ctx)
+		c.calls[key] = call
+	} else {
+		call.refs++
+	}
+	c.mu.Unlock()
+
+	release := watchCall(ctx, &c.mu, call)
+
+	// another call on the given key is in-flight: we wait for it to finish and
+	// read its content from memory. if the content could not be cached, we
+	// call the loader without populating the cache.
+	if callHit {
+		select {
+		case <-call.done:
+			release()
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+		c.mu.Lock()
+		b, ok = c.get(key)
+		c.mu.Unlock()
+		if ok {
+			return ioutil.NopCloser(bytes.NewReader(b)), nil
+		}
+		_, src, err := loader.LoadContext(ctx, key)
+		return src, err
+	}
+
+	size, src, err := loader.LoadContext(call.ctx, key)
+	if err == nil && c.entryMax > 0 && size > c.entryMax {
+		c.finishCall(key, call, nil)
+		return &releaseCloser{src, release}, nil
+	}
+	if err != nil {
+		c.finishCall(key, call, nil)
+		release()
+		return nil, err
+	}
+	t := &memTee{
+		src:     src,
+		key:     key,
+		size:    size,
+		call:    call,
+		release: release,
+		c:       c,
+	}
+	if size > 0 {
+		prealloc := size
+		if c.entryMax <= 0 && prealloc > memPreallocMax {
+			prealloc = memPreallocMax
+		}
+		t.buf = make([]byte, 0, prealloc)
+	}
+	return t, nil
+}
+
+func (c *MemoryCache) get(key string) ([]byte, bool) {
+	if c.closed {
+		return nil, false
+	}
+	value, ok := c.index.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return value.([]byte), true
+}
+
+// finishCall finishes an in-flight call, committing its content into the
+// cache if not nil, and wakes up the callers waiting for it. The least
+// important entries are evicted to stay within the budget of the cache.
+func (c *MemoryCache) finishCall(key string, call *loadCall, b []byte) {
+	c.mu.Lock()
+	defer func() {
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		c.mu.Unlock()
+		close(call.done)
+		call.cancel()
+	}()
+	if b == nil || c.closed || call.invalidated {
+		return
+	}
+	if old, ok := c.index.Remove(key); ok {
+		c.size -= int64(len(old.([]byte)))
+	}
+	c.index.Set(key, b)
+	c.size += int64(len(b))
+	for c.sizeMax > 0 && c.size > c.sizeMax {
+		_, value, ok := c.index.RemoveUnused()
+		if !ok {
+			break
+		}
+		c.size -= int64(len(value.([]byte)))
+	}
+}
+
+func (c *MemoryCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	if call, ok := c.calls[key]; ok {
+		call.invalidated = true
+	}
+	if old, ok := c.index.Remove(key); ok {
+		c.size -= int64(len(old.([]byte)))
+	}
+	return nil
+}
+
+func (c *MemoryCache) PurgeAndClose() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index = nil
+	c.size = 0
+	c.closed = true
+	return nil
+}
+
+// memTee buffers the content of a source while it is read, and commits it
+// into the cache once read entirely.
+type memTee struct {
+	src  io.ReadCloser
+	buf  []byte
+	key  string
+	size int64 // negative if unknown
+	eof  bool
+	drop bool // set when the content can not be cached
+
+	call    *loadCall
+	release func()
+
+	c      *MemoryCache
+	closed bool
+}
+
+func (t *memTee) Read(p []byte) (n int, err error) {
+	n, err = t.src.Read(p)
+	if n > 0 && !t.drop {
+		if t.c.entryMax > 0 && int64(len(t.buf)+n) > t.c.entryMax {
+			t.buf, t.drop = nil, true
+		} else {
+			t.buf = append(t.buf, p[:n]...)
+		}
+	}
+	if err == io.EOF {
+		t.eof = true
+	} else if err != nil {
+		t.buf, t.drop = nil, true
+	}
+	return
+}
+
+func (t *memTee) Close() error {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	err := t.src.Close()
+	var b []byte
+	if err == nil && t.eof && !t.drop && (t.size < 0 || int64(len(t.buf)) == t.size) {
+		b = t.buf
+		if b == nil {
+			b = []byte{}
+		}
+	}
+	t.buf, t.drop = nil, true
+	t.c.finishCall(t.key, t.call, b)
+	t.release()
+	return err
+}
+
+var _ Immutable = (*MemoryCache)(nil)
@@ -0,0 +1,214 @@
+package immcache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryCache(t *testing.T) {
+	cache := NewMemoryCache(LRUIndex(), MemoryCacheOptions{
+		SizeMax:      10,
+		EntrySizeMax: 6,
+	})
+	defer cache.PurgeAndClose()
+
+	var loads int
+	read := func(key, content string, size int64) string {
+		rc, err := cache.GetOrLoad(key, FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+			loads++
+			return size, ioutil.NopCloser(bytes.NewReader([]byte(content))), nil
+		}))
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		return string(b)
+	}
+
+	assert.Equal(t, "aaaa", read("a", "aaaa", 4))
+	assert.Equal(t, "aaaa", read("a", "----", 4))
+	assert.Equal(t, 1, loads)
+
+	// too large to be cached, with known and unknown sizes
+	assert.Equal(t, "bbbbbbbb", read("b", "bbbbbbbb", 8))
+	assert.Equal(t, "bbbbbbbb", read("b", "bbbbbbbb", -1))
+	assert.Equal(t, 3, loads)
+
+	// a partially read content is not cached
+	rc, err := cache.GetOrLoad("c", bytesLoader([]byte("cccc")))
+	if assert.NoError(t, err) {
+		rc.Read(make([]byte, 2))
+		assert.NoError(t, rc.Close())
+	}
+	assert.Equal(t, "cccc", read("c", "cccc", -1))
+	assert.Equal(t, 4, loads)
+
+	// the least recently used entry is evicted to stay within the budget
+	assert.Equal(t, "dddd", read("d", "dddd", 4))
+	assert.Equal(t, int64(8), cache.size)
+	_, ok := cache.index.Get("a")
+	assert.False(t, ok)
+
+	assert.NoError(t, cache.Delete("c"))
+	assert.Equal(t, int64(4), cache.size)
+	assert.Equal(t, "c2", read("c", "c2", 2))
+	assert.Equal(t, 6, loads)
+
+	// without a budget, the size reported by the loader is not preallocated
+	unlimited := NewMemoryCache(LRUIndex(), MemoryCacheOptions{})
+	rc, err = unlimited.GetOrLoad("e", FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+		return 1 << 62, ioutil.NopCloser(bytes.NewReader([]byte("eeee"))), nil
+	}))
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		assert.Equal(t, "eeee", string(b))
+	}
+	assert.Len(t, unlimited.calls, 0)
+}
+
+func TestMemoryCacheSingleFlight(t *testing.T) {
+	cache := NewMemoryCache(LRUIndex(), MemoryCacheOptions{SizeMax: 1024})
+	defer cache.PurgeAndClose()
+
+	var loads int32
+	unblock := make(chan struct{})
+	loader := FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+		atomic.AddInt32(&loads, 1)
+		<-unblock
+		return 4, ioutil.NopCloser(bytes.NewReader([]byte("toto"))), nil
+	})
+
+	const concurrency = 16
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			rc, err := cache.GetOrLoad("key", loader)
+			if !assert.NoError(t, err) {
+				return
+			}
+			b, err := ioutil.ReadAll(rc)
+			assert.NoError(t, err)
+			assert.NoError(t, rc.Close())
+			assert.Equal(t, "toto", string(b))
+		}()
+	}
+
+	// a waiter can give up on the in-flight load
+	for {
+		cache.mu.Lock()
+		call, ok := cache.calls["key"]
+		refs := 0
+		if ok {
+			refs = call.refs
+		}
+		cache.mu.Unlock()
+		if refs == concurrency {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err := cache.GetOrLoadContext(ctx, "key", contextLoader{loader})
+	assert.Equal(t, context.Canceled, err)
+
+	close(unblock)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+	assert.Len(t, cache.calls, 0)
+
+	// a key deleted while loading is not cached
+	rc, err := cache.GetOrLoad("deleted", bytesLoader([]byte("titi")))
+	if assert.NoError(t, err) {
+		assert.NoError(t, cache.Delete("deleted"))
+		_, err = ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+	}
+	_, ok := cache.index.Get("deleted")
+	assert.False(t, ok)
+
+	// the loader is cancelled once no caller is interested anymore
+	ctx, cancel = context.WithCancel(context.Background())
+	_, err = cache.GetOrLoadContext(ctx, "cancelled", FuncContextLoader(func(ctx context.Context, _ string) (int64, io.ReadCloser, error) {
+		cancel()
+		<-ctx.Done()
+		return 0, nil, ctx.Err()
+	}))
+	assert.Equal(t, context.Canceled, err)
+	assert.Len(t, cache.calls, 0)
+}
+
+func TestTiered(t *testing.T) {
+	memory := NewMemoryCache(LRUIndex(), MemoryCacheOptions{
+		SizeMax:      1024,
+		EntrySizeMax: 4,
+	})
+	disk := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-tiered-test",
+		DiskSizeMax:    1024,
+
+		EvictionPeriodMin:      time.Hour,
+		EvictionEmergencyRatio: 100,
+	})
+	cache := NewTiered(memory, disk)
+	defer cache.PurgeAndClose()
+
+	var loads int
+	read := func(key, content string) string {
+		rc, err := cache.GetOrLoad(key, FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+			loads++
+			return int64(len(content)), ioutil.NopCloser(bytes.NewReader([]byte(content))), nil
+		}))
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		return string(b)
+	}
+
+	// small contents are served from the memory after the first load
+	assert.Equal(t, "toto", read("small", "toto"))
+	assert.Equal(t, "toto", read("small", "toto"))
+	assert.Equal(t, 1, loads)
+	assert.Equal(t, int64(0), disk.Stats().Hits)
+
+	// larger contents are only kept on the disk
+	assert.Equal(t, "larger", read("large", "larger"))
+	assert.Equal(t, "larger", read("large", "larger"))
+	assert.Equal(t, 2, loads)
+	assert.Equal(t, int64(1), disk.Stats().Hits)
+
+	// an entry evicted from the memory is promoted again from the disk
+	assert.NoError(t, memory.Delete("small"))
+	assert.Equal(t, "toto", read("small", "toto"))
+	assert.Equal(t, int64(2), disk.Stats().Hits)
+	assert.Equal(t, "toto", read("small", "toto"))
+	assert.Equal(t, int64(2), disk.Stats().Hits)
+	assert.Equal(t, 2, loads)
+
+	assert.NoError(t, cache.Delete("small"))
+	assert.Equal(t, "titi", read("small", "titi"))
+	assert.Equal(t, 3, loads)
+}
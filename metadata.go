@@ -0,0 +1,93 @@
+package immcache
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"hash"
+	"io"
+	"time"
+)
+
+// Metadata describes a content, for instance the headers of the response from
+// which it was loaded. It is returned by a MetadataLoader along with the
+// content, and stored with the entry of its key.
+type Metadata struct {
+	ContentType  string            `json:"type,omitempty"`
+	ETag         string            `json:"etag,omitempty"`
+	LastModified time.Time         `json:"modified"`
+	Extra        map[string]string `json:"extra,omitempty"`
+}
+
+// MetadataLoader is a ContextLoader also returning the metadata of the
+// content, nil if it has none.
+type MetadataLoader interface {
+	LoadMetadata(ctx context.Context, key string) (int64, *Metadata, io.ReadCloser, error)
+}
+
+// FuncMetadataLoader can be used to turn a loader function into a
+// MetadataLoader. It is also a ContextLoader ignoring the metadata.
+type FuncMetadataLoader func(ctx context.Context, key string) (int64, *Metadata, io.ReadCloser, error)
+
+func (f FuncMetadataLoader) LoadMetadata(ctx context.Context, key string) (int64, *Metadata, io.ReadCloser, error) {
+	return f(ctx, key)
+}
+
+func (f FuncMetadataLoader) LoadContext(ctx context.Context, key string) (int64, io.ReadCloser, error) {
+	size, _, rc, err := f(ctx, key)
+	return size, rc, err
+}
+
+// metadataLoader turns a ContextLoader into a MetadataLoader returning no
+// metadata.
+type metadataLoader struct {
+	l ContextLoader
+}
+
+func (l metadataLoader) LoadMetadata(ctx context.Context, key string) (int64, *Metadata, io.ReadCloser, error) {
+	size, rc, err := l.l.LoadContext(ctx, key)
+	return size, nil, rc, err
+}
+
+// encodeMetadata returns the encoded form of the metadata stored in the
+// entries, nil if there is no metadata.
+func encodeMetadata(meta *Metadata) []byte {
+	if meta == nil {
+		return nil
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// decodeMetadata returns the metadata of an entry, nil if it has none.
+func decodeMetadata(b []byte) *Metadata {
+	if b == nil {
+		return nil
+	}
+	meta := new(Metadata)
+	if err := json.Unmarshal(b, meta); err != nil {
+		return nil
+	}
+	return meta
+}
+
+// metadataSum returns the sum authenticating the metadata of an entry, bound
+// to the sum of its content so that the metadata of an entry cannot be given
+// to another one.
+func metadataSum(h hash.Hash, sum, meta []byte) []byte {
+	h.Write(sum)
+	h.Write(meta)
+	return h.Sum(nil)
+}
+
+// validMetadata returns whether the metadata of the given entry matches its
+// sum.
+func (c *DiskCache) validMetadata(entry diskEntry) bool {
+	if entry.meta == nil {
+		return entry.metaSum == nil
+	}
+	return hmac.Equal(metadataSum(c.hash(), entry.sum, entry.meta), entry.metaSum)
+}
@@ -0,0 +1,145 @@
+package immcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskCacheMetadata(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "cozy-metadata-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(basePath)
+
+	opts := DiskCacheOptions{
+		BasePath:     basePath,
+		Secret:       []byte("secret"),
+		PersistIndex: true,
+	}
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var loads int
+	loader := FuncMetadataLoader(func(_ context.Context, key string) (int64, *Metadata, io.ReadCloser, error) {
+		loads++
+		meta := &Metadata{
+			ContentType:  "text/css",
+			ETag:         `"origin-` + key + `"`,
+			LastModified: modified,
+			Extra:        map[string]string{"key": key},
+		}
+		return 4, meta, ioutil.NopCloser(strings.NewReader("body")), nil
+	})
+	get := func(cache *DiskCache, key string) *Metadata {
+		rc, meta, err := cache.GetOrLoadMetadata(context.Background(), key, loader)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		assert.Equal(t, "body", string(b))
+		return meta
+	}
+	check := func(meta *Metadata, key string) {
+		if assert.NotNil(t, meta) {
+			assert.Equal(t, "text/css", meta.ContentType)
+			assert.Equal(t, `"origin-`+key+`"`, meta.ETag)
+			assert.True(t, modified.Equal(meta.LastModified))
+			assert.Equal(t, map[string]string{"key": key}, meta.Extra)
+		}
+	}
+
+	cache := NewDiskCache(LRUIndex(), opts)
+	for i := 0; i < 2; i++ {
+		check(get(cache, "key1"), "key1")
+		check(get(cache, "key2"), "key2")
+	}
+	assert.Equal(t, 2, loads)
+	assert.Equal(t, int64(2), cache.Stats().Hits)
+
+	// the entries sharing the same content keep their own metadata, and the
+	// entries loaded without metadata have none.
+	rc, meta, err := cache.GetOrLoadMetadata(context.Background(), "key3", metadataLoader{contextLoader{bytesLoader([]byte("body"))}})
+	if assert.NoError(t, err) {
+		_, err = ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+	}
+	assert.Nil(t, meta)
+	rc, meta, err = cache.GetOrLoadMetadata(context.Background(), "key3", loader)
+	if assert.NoError(t, err) {
+		assert.NoError(t, rc.Close())
+	}
+	assert.Nil(t, meta)
+	assert.Equal(t, 2, loads)
+	assert.NoError(t, cache.Close())
+
+	// the metadata are restored with the index
+	cache = NewDiskCache(LRUIndex(), opts)
+	check(get(cache, "key1"), "key1")
+	check(get(cache, "key2"), "key2")
+	assert.Equal(t, 2, loads)
+	assert.NoError(t, cache.Close())
+
+	// a tampered metadata drops its entry
+	filename := filepath.Join(basePath, journalFilename)
+	journal, err := ioutil.ReadFile(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	lines := bytes.Split(journal, []byte("\n"))
+	for i, line := range lines {
+		fields := bytes.Split(line, []byte(" "))
+		if len(fields) == 6 && string(fields[0]) == "S" && string(fields[5]) == `"key1"` {
+			b, _ := base64.RawStdEncoding.DecodeString(string(fields[4]))
+			b = bytes.Replace(b, []byte("text/css"), []byte("text/html"), 1)
+			fields[4] = []byte(base64.RawStdEncoding.EncodeToString(b))
+			lines[i] = bytes.Join(fields, []byte(" "))
+		}
+	}
+	assert.NoError(t, ioutil.WriteFile(filename, bytes.Join(lines, []byte("\n")), 0600))
+
+	cache = NewDiskCache(LRUIndex(), opts)
+	defer cache.PurgeAndClose()
+	check(get(cache, "key2"), "key2")
+	assert.Equal(t, 2, loads)
+	check(get(cache, "key1"), "key1")
+	assert.Equal(t, 3, loads)
+}
+
+func TestHandlerMetadata(t *testing.T) {
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-handler-test",
+		DiskSizeMax:    1 << 20,
+	})
+	defer cache.PurgeAndClose()
+
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	handler := NewHandler(cache, HandlerOptions{
+		Loader: FuncMetadataLoader(func(_ context.Context, key string) (int64, *Metadata, io.ReadCloser, error) {
+			meta := &Metadata{ContentType: "text/x-custom", LastModified: modified}
+			return 4, meta, ioutil.NopCloser(strings.NewReader("body")), nil
+		}),
+	})
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/style.css", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "body", w.Body.String())
+		assert.Equal(t, "text/x-custom", w.Header().Get("Content-Type"))
+		assert.Equal(t, modified.Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+	}
+}
@@ -0,0 +1,225 @@
+// Package metrics exposes the statistics of a DiskCache in the OpenMetrics
+// text format, so that they can be scraped by Prometheus without depending on
+// its client library.
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinroh/immcache"
+)
+
+// ContentType is the content type of the exposed metrics.
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// DefaultBuckets are the default upper bounds, in seconds, of the buckets of
+// the load duration histogram.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Collector collects the metrics of a DiskCache. The statistics of the cache
+// are read on each scrape. The duration of the loads are only measured for the
+// loaders wrapped by the collector.
+type Collector struct {
+	name    string
+	cache   *immcache.DiskCache
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64 // count of observations by bucket, non-cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewCollector returns a collector for the given cache, whose metrics are
+// labelled with the given name. If buckets is nil, DefaultBuckets is used.
+func NewCollector(name string, cache *immcache.DiskCache, buckets []float64) *Collector {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	return &Collector{
+		name:    name,
+		cache:   cache,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+// WrapLoader returns a Loader measuring the duration of the calls of the given
+// loader, until it returns the content to stream.
+func (c *Collector) WrapLoader(l immcache.Loader) immcache.Loader {
+	return immcache.FuncLoader(func(key string) (int64, io.ReadCloser, error) {
+		defer c.observe(time.Now())
+		return l.Load(key)
+	})
+}
+
+// WrapContextLoader is like WrapLoader for a ContextLoader.
+func (c *Collector) WrapContextLoader(l immcache.ContextLoader) immcache.ContextLoader {
+	return immcache.FuncContextLoader(func(ctx context.Context, key string) (int64, io.ReadCloser, error) {
+		defer c.observe(time.Now())
+		return l.LoadContext(ctx, key)
+	})
+}
+
+func (c *Collector) observe(start time.Time) {
+	d := time.Since(start).Seconds()
+	i := 0
+	for i < len(c.buckets) && d > c.buckets[i] {
+		i++
+	}
+	c.mu.Lock()
+	c.counts[i]++
+	c.sum += d
+	c.count++
+	c.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics of the collector.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	Handler(c).ServeHTTP(w, r)
+}
+
+// Handler returns an http.Handler exposing the metrics of the given
+// collectors.
+func Handler(collectors ...*Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		WriteMetrics(w, collectors...)
+	})
+}
+
+type family struct {
+	name, typ, unit, help string
+	samples               func(w *bufio.Writer, c *Collector, s *immcache.DiskCacheStats)
+}
+
+var families = []family{
+	{"immcache_requests", "counter", "", "Number of calls of the cache by outcome.",
+		func(w *bufio.Writer, c *Collector, s *immcache.DiskCacheStats) {
+			writeSample(w, "immcache_requests_total", c.name, `outcome="hit"`, float64(s.Hits))
+			writeSample(w, "immcache_requests_total", c.name, `outcome="miss"`, float64(s.Misses))
+			writeSample(w, "immcache_requests_total", c.name, `outcome="coalesced"`, float64(s.Coalesced))
+			writeSample(w, "immcache_requests_total", c.name, `outcome="negative"`, float64(s.NegativeHits))
+		}},
+	{"immcache_load_errors", "counter", "", "Number of errors returned by the loader.",
+		func(w *bufio.Writer, c *Collector, s *immcache.DiskCacheStats) {
+			writeSample(w, "immcache_load_errors_total", c.name, "", float64(s.LoadErrors))
+		}},
+	{"immcache_corruptions", "counter", "", "Number of corrupted files detected when read or scrubbed.",
+		func(w *bufio.Writer, c *Collector, s *immcache.DiskCacheStats) {
+			writeSample(w, "immcache_corruptions_total", c.name, "", float64(s.Corruptions))
+		}},
+	{"immcache_evictions", "counter", "", "Number of eviction runs.",
+		func(w *bufio.Writer, c *Collector, s *immcache.DiskCacheStats) {
+			writeSample(w, "immcache_evictions_total", c.name, "", float64(s.EvictionRuns))
+		}},
+	{"immcache_evicted_entries", "counter", "", "Number of entries removed by the evictions.",
+		func(w *bufio.Writer, c *Collector, s *immcache.DiskCacheStats) {
+			writeSample(w, "immcache_evicted_entries_total", c.name, "", float64(s.EvictedEntries))
+		}},
+	{"immcache_evicted_bytes", "counter", "bytes", "Number of bytes freed by the evictions.",
+		func(w *bufio.Writer, c *Collector, s *immcache.DiskCacheStats) {
+			writeSample(w, "immcache_evicted_bytes_total", c.name, "", float64(s.EvictedBytes))
+		}},
+	{"immcache_scrubs", "counter", "", "Number of complete passes of the scrubber.",
+		func(w *bufio.Writer, c *Collector, s *immcache.DiskCacheStats) {
+			writeSample(w, "immcache_scrubs_total", c.name, "", float64(s.ScrubRuns))
+		}},
+	{"immcache_scrubbed_bytes", "counter", "bytes", "Number of bytes read by the scrubber.",
+		func(w *bufio.Writer, c *Collector, s *immcache.DiskCacheStats) {
+			writeSample(w, "immcache_scrubbed_bytes_total", c.name, "", float64(s.ScrubbedBytes))
+		}},
+	{"immcache_disk_bytes", "gauge", "bytes", "Number of bytes stored on the disk.",
+		func(w *bufio.Writer, c *Collector, s *immcache.DiskCacheStats) {
+			writeSample(w, "immcache_disk_bytes", c.name, "", float64(s.Size))
+		}},
+	{"immcache_disk_max_bytes", "gauge", "bytes", "Maximum number of bytes stored on the disk, 0 if unlimited.",
+		func(w *bufio.Writer, c *Collector, s *immcache.DiskCacheStats) {
+			writeSample(w, "immcache_disk_max_bytes", c.name, "", float64(s.SizeMax))
+		}},
+	{"immcache_entries", "gauge", "", "Number of keys in the index.",
+		func(w *bufio.Writer, c *Collector, s *immcache.DiskCacheStats) {
+			writeSample(w, "immcache_entries", c.name, "", float64(s.Entries))
+		}},
+	{"immcache_loads_in_flight", "gauge", "", "Number of in-flight loads.",
+		func(w *bufio.Writer, c *Collector, s *immcache.DiskCacheStats) {
+			writeSample(w, "immcache_loads_in_flight", c.name, "", float64(s.InFlight))
+		}},
+	{"immcache_negative_entries", "gauge", "", "Number of loader errors cached.",
+		func(w *bufio.Writer, c *Collector, s *immcache.DiskCacheStats) {
+			writeSample(w, "immcache_negative_entries", c.name, "", float64(s.NegativeEntries))
+		}},
+	{"immcache_load_duration_seconds", "histogram", "seconds", "Duration of the calls of the loader.",
+		func(w *bufio.Writer, c *Collector, _ *immcache.DiskCacheStats) {
+			c.mu.Lock()
+			counts := append([]uint64(nil), c.counts...)
+			sum, count := c.sum, c.count
+			c.mu.Unlock()
+			var cumul uint64
+			for i, n := range counts {
+				cumul += n
+				le := math.Inf(1)
+				if i < len(c.buckets) {
+					le = c.buckets[i]
+				}
+				writeSample(w, "immcache_load_duration_seconds_bucket", c.name,
+					`le="`+formatFloat(le)+`"`, float64(cumul))
+			}
+			writeSample(w, "immcache_load_duration_seconds_count", c.name, "", float64(count))
+			writeSample(w, "immcache_load_duration_seconds_sum", c.name, "", sum)
+		}},
+}
+
+// WriteMetrics writes the metrics of the given collectors in the OpenMetrics
+// text format.
+func WriteMetrics(w io.Writer, collectors ...*Collector) error {
+	stats := make([]immcache.DiskCacheStats, len(collectors))
+	for i, c := range collectors {
+		stats[i] = c.cache.Stats()
+	}
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.typ)
+		if f.unit != "" {
+			fmt.Fprintf(bw, "# UNIT %s %s\n", f.name, f.unit)
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, f.help)
+		for i, c := range collectors {
+			f.samples(bw, c, &stats[i])
+		}
+	}
+	bw.WriteString("# EOF\n")
+	return bw.Flush()
+}
+
+func writeSample(w *bufio.Writer, name, cache, labels string, value float64) {
+	w.WriteString(name)
+	w.WriteString(`{cache="`)
+	w.WriteString(labelEscaper.Replace(cache))
+	w.WriteByte('"')
+	if labels != "" {
+		w.WriteByte(',')
+		w.WriteString(labels)
+	}
+	w.WriteString("} ")
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
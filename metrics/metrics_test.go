@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/jinroh/immcache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollector(t *testing.T) {
+	cache := immcache.NewDiskCache(immcache.LRUIndex(), immcache.DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-metrics-test",
+		DiskSizeMax:    1 << 20,
+	})
+	defer cache.PurgeAndClose()
+
+	collector := NewCollector(`my "cache"`, cache, []float64{1, 10})
+	loader := collector.WrapLoader(immcache.FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+		return 4, ioutil.NopCloser(bytes.NewReader([]byte("toto"))), nil
+	}))
+
+	for i := 0; i < 3; i++ {
+		rc, err := cache.GetOrLoad("key", loader)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+	}
+
+	w := httptest.NewRecorder()
+	collector.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, ContentType, w.Header().Get("Content-Type"))
+
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE immcache_requests counter\n",
+		`immcache_requests_total{cache="my \"cache\"",outcome="hit"} 2` + "\n",
+		`immcache_requests_total{cache="my \"cache\"",outcome="miss"} 1` + "\n",
+		`immcache_disk_bytes{cache="my \"cache\""} 4` + "\n",
+		`immcache_disk_max_bytes{cache="my \"cache\""} 1.048576e+06` + "\n",
+		`immcache_entries{cache="my \"cache\""} 1` + "\n",
+		"# TYPE immcache_load_duration_seconds histogram\n",
+		`immcache_load_duration_seconds_bucket{cache="my \"cache\"",le="1"} 1` + "\n",
+		`immcache_load_duration_seconds_bucket{cache="my \"cache\"",le="+Inf"} 1` + "\n",
+		`immcache_load_duration_seconds_count{cache="my \"cache\""} 1` + "\n",
+	} {
+		assert.Contains(t, body, line)
+	}
+	assert.Contains(t, body, "# EOF\n")
+}
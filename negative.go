@@ -0,0 +1,60 @@
+package immcache
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const negativeSweepMin = 1024
+
+type negativeEntry struct {
+	err     error
+	expires time.Time
+}
+
+func (c *DiskCache) negativeCacheable(err error) bool {
+	if c.opts.NegativeTTL <= 0 {
+		return false
+	}
+	if c.opts.NegativeCacheable != nil {
+		return c.opts.NegativeCacheable(err)
+	}
+	return errors.Is(err, ErrNotFound)
+}
+
+// getNegative returns the cached error of the given key, or nil. Must be called
+// with mu held.
+func (c *DiskCache) getNegative(key string) error {
+	entry, ok := c.negatives[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.negatives, key)
+		return nil
+	}
+	atomic.AddInt64(&c.stats.negativeHits, 1)
+	return entry.err
+}
+
+// setNegative caches the given loader error for the key if it is cacheable.
+// The expired entries are swept when the number of cached errors has grown
+// since the last sweep.
+func (c *DiskCache) setNegative(key string, err error) {
+	if !c.negativeCacheable(err) {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.negatives[key] = negativeEntry{err, now.Add(c.opts.NegativeTTL)}
+	if len(c.negatives) >= c.negativesSweep {
+		for k, entry := range c.negatives {
+			if now.After(entry.expires) {
+				delete(c.negatives, k)
+			}
+		}
+		c.negativesSweep = 2*len(c.negatives) + negativeSweepMin
+	}
+}
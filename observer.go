@@ -0,0 +1,52 @@
+package immcache
+
+import (
+	"context"
+	"time"
+)
+
+// Observer receives the events of the lifecycle of the entries of a
+// DiskCache, for instance to plug logging, tracing or auditing. Its methods are
+// called synchronously, sometimes while holding the lock of the cache: they
+// should not block nor call the cache.
+//
+// The context given to the events of a load is the one given to the loader.
+// NopObserver can be embedded to implement only some of the methods.
+type Observer interface {
+	// OnHit is called when a call is served from the disk.
+	OnHit(ctx context.Context, key string)
+	// OnMiss is called when a call starts a load to populate the cache.
+	OnMiss(ctx context.Context, key string)
+	// OnCoalesced is called when a call joins an in-flight load of its key.
+	OnCoalesced(ctx context.Context, key string)
+	// OnBypass is called when the loaded content is too large to be cached.
+	OnBypass(ctx context.Context, key string, size int64)
+	// OnLoadStart and OnLoadDone are called around the calls of the loader.
+	OnLoadStart(ctx context.Context, key string)
+	OnLoadDone(ctx context.Context, key string, size int64, err error, d time.Duration)
+	// OnCommit is called when a loaded content has been streamed, with the
+	// error that prevented it from being committed into the cache, if any.
+	OnCommit(ctx context.Context, key string, size int64, err error, d time.Duration)
+	// OnEvict is called when an entry is removed by the eviction.
+	OnEvict(key string, size int64)
+	// OnCorruption is called when a corrupted file is detected, for each of
+	// the keys removed with it when detected by the scrubber.
+	OnCorruption(key string)
+}
+
+// NopObserver is an Observer ignoring all the events.
+type NopObserver struct{}
+
+func (NopObserver) OnHit(ctx context.Context, key string)                {}
+func (NopObserver) OnMiss(ctx context.Context, key string)               {}
+func (NopObserver) OnCoalesced(ctx context.Context, key string)          {}
+func (NopObserver) OnBypass(ctx context.Context, key string, size int64) {}
+func (NopObserver) OnLoadStart(ctx context.Context, key string)          {}
+func (NopObserver) OnLoadDone(ctx context.Context, key string, size int64, err error, d time.Duration) {
+}
+func (NopObserver) OnCommit(ctx context.Context, key string, size int64, err error, d time.Duration) {
+}
+func (NopObserver) OnEvict(key string, size int64) {}
+func (NopObserver) OnCorruption(key string)        {}
+
+var _ Observer = NopObserver{}
@@ -0,0 +1,274 @@
+package immcache
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultGroupPath     = "/_immcache/"
+	defaultGroupReplicas = 50
+
+	sumTrailer = "Immcache-Sum"
+)
+
+var (
+	errPeerUnavailable = errors.New("immcache: peer unavailable")
+	errGroupLoader     = errors.New("immcache: a group requires a Loader")
+	errGroupRandom     = errors.New("immcache: a group cannot use the random key of HashKeyedRandom")
+)
+
+// Group distributes the loads of a set of peers, each one with its own
+// DiskCache, so that each content is loaded only once from the origin. The
+// keys are distributed among the peers with a consistent hash: the peer owning
+// a key is the only one calling the real loader, the other peers loading the
+// content from the owner over HTTP. Each peer keeps on caching the contents it
+// serves.
+//
+// The contents sent between the peers are checked with the HMAC sums of the
+// cache: all the peers must share the same key, either the same Secret or the
+// HashUnkeyed mode. The random key of HashKeyedRandom cannot be used.
+type Group struct {
+	self   string
+	path   string
+	cache  *DiskCache
+	loader Loader
+	client *http.Client
+
+	mu       sync.RWMutex
+	replicas int
+	ring     []uint32          // sorted hashes of the virtual nodes, owned by mu
+	peers    map[uint32]string // peers by virtual node, owned by mu
+}
+
+// GroupOptions are the options to create a group.
+type GroupOptions struct {
+	// Self is the base URL of the local peer, e.g. "http://10.0.0.1:8080".
+	Self string
+	// Peers are the base URLs of all the peers of the group, including Self.
+	Peers []string
+
+	// Loader is called for the keys owned by the local peer, including on
+	// behalf of the other peers.
+	Loader Loader
+
+	// Path is the path on which the peers serve their contents, by default
+	// "/_immcache/".
+	Path string
+	// Replicas is the number of virtual nodes of each peer on the hash ring,
+	// by default 50.
+	Replicas int
+	// Client is the client used to query the peers, by default
+	// http.DefaultClient.
+	Client *http.Client
+}
+
+// NewGroup returns a group in which the local peer stores its contents in the
+// given cache. The group must be served by the local peer on its path. It
+// returns an error if no Loader is given, or if the cache uses a random key.
+func NewGroup(cache *DiskCache, opts GroupOptions) (*Group, error) {
+	if opts.Loader == nil {
+		return nil, errGroupLoader
+	}
+	if cache.hashMode() == HashKeyedRandom {
+		return nil, errGroupRandom
+	}
+	g := &Group{
+		self:     strings.TrimSuffix(opts.Self, "/"),
+		path:     opts.Path,
+		cache:    cache,
+		loader:   opts.Loader,
+		client:   opts.Client,
+		replicas: opts.Replicas,
+	}
+	if g.path == "" {
+		g.path = defaultGroupPath
+	}
+	if g.client == nil {
+		g.client = http.DefaultClient
+	}
+	if g.replicas <= 0 {
+		g.replicas = defaultGroupReplicas
+	}
+	g.SetPeers(opts.Peers...)
+	return g, nil
+}
+
+// SetPeers updates the peers of the group. The keys owned by the peers that
+// are removed are redistributed among the others.
+func (g *Group) SetPeers(peers ...string) {
+	ring := make([]uint32, 0, len(peers)*g.replicas)
+	byHash := make(map[uint32]string, len(peers)*g.replicas)
+	for _, peer := range peers {
+		peer = strings.TrimSuffix(peer, "/")
+		for i := 0; i < g.replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peer))
+			if _, ok := byHash[h]; !ok {
+				ring = append(ring, h)
+			}
+			byHash[h] = peer
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i] < ring[j] })
+	g.mu.Lock()
+	g.ring, g.peers = ring, byHash
+	g.mu.Unlock()
+}
+
+// owner returns the base URL of the peer owning the given key.
+func (g *Group) owner(key string) string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if len(g.ring) == 0 {
+		return g.self
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(g.ring), func(i int) bool { return g.ring[i] >= h })
+	if i == len(g.ring) {
+		i = 0
+	}
+	return g.peers[g.ring[i]]
+}
+
+// GetOrLoad returns the content of the given key from the local cache, or
+// from the peer owning the key. The given loader is called if the local peer
+// owns the key, or if its owner is not available.
+func (g *Group) GetOrLoad(key string, loader Loader) (io.ReadCloser, error) {
+	return g.GetOrLoadContext(context.Background(), key, contextLoader{loader})
+}
+
+// GetOrLoadContext is like GetOrLoad with a context, given to the requests
+// made to the owner of the key.
+func (g *Group) GetOrLoadContext(ctx context.Context, key string, loader ContextLoader) (io.ReadCloser, error) {
+	owner := g.owner(key)
+	if owner == g.self {
+		return g.cache.GetOrLoadContext(ctx, key, loader)
+	}
+	return g.cache.GetOrLoadContext(ctx, key, FuncContextLoader(func(ctx context.Context, key string) (int64, io.ReadCloser, error) {
+		size, rc, err := g.fetch(ctx, owner, key)
+		if err == errPeerUnavailable {
+			return loader.LoadContext(ctx, key)
+		}
+		return size, rc, err
+	}))
+}
+
+// Delete removes the key from the local cache only.
+func (g *Group) Delete(key string) error {
+	return g.cache.Delete(key)
+}
+
+// PurgeAndClose purges and closes the local cache.
+func (g *Group) PurgeAndClose() error {
+	return g.cache.PurgeAndClose()
+}
+
+// fetch loads the content of a key from its owner. It returns
+// errPeerUnavailable if the owner could not serve the content.
+func (g *Group) fetch(ctx context.Context, owner, key string) (int64, io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, owner+g.path+url.PathEscape(key), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	res, err := g.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, nil, ctx.Err()
+		}
+		return 0, nil, errPeerUnavailable
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return -1, &peerBody{body: res.Body, res: res, h: g.cache.hash()}, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return 0, nil, ErrNotFound
+	case http.StatusBadGateway:
+		b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return 0, nil, fmt.Errorf("immcache: peer %s: %s", owner, strings.TrimSpace(string(b)))
+	default:
+		res.Body.Close()
+		return 0, nil, errPeerUnavailable
+	}
+}
+
+// ServeHTTP serves the contents of the keys requested by the other peers. The
+// content is loaded by the local peer, even if it does not own the key
+// according to its view of the group, to avoid loops between peers.
+func (g *Group) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.URL.EscapedPath(), g.path) {
+		http.NotFound(w, r)
+		return
+	}
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), g.path))
+	if err != nil {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+	rc, err := g.cache.GetOrLoadContext(r.Context(), key, contextLoader{g.loader})
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Trailer", sumTrailer)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	h := g.cache.hash()
+	_, err = io.Copy(io.MultiWriter(w, h), rc)
+	// the integrity of a content read from the disk is checked on close. on
+	// error, the missing trailer makes the peer drop the content.
+	if errc := rc.Close(); err == nil {
+		err = errc
+	}
+	if err == nil {
+		w.Header().Set(sumTrailer, hex.EncodeToString(h.Sum(nil)))
+	}
+}
+
+// peerBody checks the content received from a peer against the sum sent in
+// the trailer of the response.
+type peerBody struct {
+	body io.ReadCloser
+	res  *http.Response
+	h    hash.Hash
+}
+
+func (b *peerBody) Read(p []byte) (n int, err error) {
+	n, err = b.body.Read(p)
+	b.h.Write(p[:n])
+	if err == io.EOF {
+		sum, errd := hex.DecodeString(b.res.Trailer.Get(sumTrailer))
+		if errd != nil || !hmac.Equal(sum, b.h.Sum(nil)) {
+			err = errCorruptedCache
+		}
+	}
+	return
+}
+
+func (b *peerBody) Close() error {
+	return b.body.Close()
+}
+
+var _ Immutable = (*Group)(nil)
@@ -0,0 +1,141 @@
+package immcache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroup(t *testing.T) {
+	const peersLen = 3
+
+	var loads int32
+	origin := FuncLoader(func(key string) (int64, io.ReadCloser, error) {
+		atomic.AddInt32(&loads, 1)
+		if key == "missing" {
+			return 0, nil, ErrNotFound
+		}
+		b := []byte("content of " + key)
+		return int64(len(b)), ioutil.NopCloser(bytes.NewReader(b)), nil
+	})
+
+	var handlers [peersLen]http.Handler
+	var servers [peersLen]*httptest.Server
+	var peers []string
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		}))
+		defer servers[i].Close()
+		peers = append(peers, servers[i].URL)
+	}
+
+	var groups [peersLen]*Group
+	for i := range groups {
+		cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+			BasePath:       os.TempDir(),
+			BasePathPrefix: "cozy-group-test",
+			Secret:         []byte("shared secret"),
+		})
+		defer cache.PurgeAndClose()
+		g, err := NewGroup(cache, GroupOptions{
+			Self:   peers[i],
+			Peers:  peers,
+			Loader: origin,
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		groups[i], handlers[i] = g, g
+	}
+
+	read := func(g *Group, key string) (string, error) {
+		rc, err := g.GetOrLoad(key, origin)
+		if err != nil {
+			return "", err
+		}
+		b, err := ioutil.ReadAll(rc)
+		if errc := rc.Close(); err == nil {
+			err = errc
+		}
+		return string(b), err
+	}
+
+	// the peers agree on the owners of the keys, spread among them
+	owners := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		key := "key" + strconv.Itoa(i)
+		owner := groups[0].owner(key)
+		for _, g := range groups[1:] {
+			assert.Equal(t, owner, g.owner(key))
+		}
+		owners[owner] = true
+	}
+	assert.Len(t, owners, peersLen)
+
+	// each content is loaded once from the origin, whatever the peer
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		key := "key" + strconv.Itoa(i)
+		for _, g := range groups {
+			wg.Add(1)
+			go func(g *Group) {
+				defer wg.Done()
+				content, err := read(g, key)
+				assert.NoError(t, err)
+				assert.Equal(t, "content of "+key, content)
+			}(g)
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, int32(30), atomic.LoadInt32(&loads))
+
+	for _, g := range groups {
+		_, err := read(g, "missing")
+		assert.Equal(t, ErrNotFound, err)
+	}
+
+	// a content altered between the peers is not accepted
+	var key string
+	for i := 0; key == ""; i++ {
+		if k := "altered" + strconv.Itoa(i); groups[0].owner(k) == peers[1] {
+			key = k
+		}
+	}
+	handlers[1] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", sumTrailer)
+		w.Write([]byte("altered content"))
+		w.Header().Set(sumTrailer, "00")
+	})
+	_, err := read(groups[0], key)
+	assert.Equal(t, errCorruptedCache, err)
+
+	// the loader is called when the owner is not available
+	servers[1].Close()
+	atomic.StoreInt32(&loads, 0)
+	content, err := read(groups[0], key)
+	assert.NoError(t, err)
+	assert.Equal(t, "content of "+key, content)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+}
+
+func TestNewGroupErrors(t *testing.T) {
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{Secret: []byte("shared secret")})
+	_, err := NewGroup(cache, GroupOptions{})
+	assert.Equal(t, errGroupLoader, err)
+
+	// the cache uses a random key by default
+	cache = NewDiskCache(LRUIndex(), DiskCacheOptions{})
+	_, err = NewGroup(cache, GroupOptions{Loader: bytesLoader(nil)})
+	assert.Equal(t, errGroupRandom, err)
+}
@@ -0,0 +1,145 @@
+package immcache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"path/filepath"
+)
+
+var (
+	errRekeyBasePath = errors.New("immcache: rekey requires a fixed BasePath and an empty BasePathPrefix")
+	errRekeyRandom   = errors.New("immcache: cannot rekey with a random key")
+	errRekeyInit     = errors.New("immcache: could not open the cache directory")
+)
+
+// Rekey re-signs with the current key the files of a cache directory written
+// under one of the PreviousSecrets of the given options, like a cache created
+// with these options does in the background after its initialization. It can
+// be used to rotate the key of a directory offline, while no cache is using
+// it. The journal of the directory, if any, is re-keyed along with its entries.
+func Rekey(opts DiskCacheOptions) error {
+	if opts.BasePath == "" || opts.BasePathPrefix != "" {
+		return errRekeyBasePath
+	}
+	fs := opts.Storage
+	if fs == nil {
+		fs = OSStorage{}
+	}
+	if _, err := fs.Stat(filepath.Join(opts.BasePath, journalFilename)); err == nil {
+		opts.PersistIndex = true
+	}
+	opts.DiskSizeMax = 0
+	c := NewDiskCache(LRUIndex(), opts)
+	if c.hashMode() == HashKeyedRandom {
+		return errRekeyRandom
+	}
+	if !c.init() {
+		return errRekeyInit
+	}
+	<-c.verified
+	return c.Close()
+}
+
+// newHash returns the hash of the sums under the given key, plain SHA-256 if
+// it is nil.
+func newHash(secret []byte) hash.Hash {
+	if secret != nil {
+		return hmac.New(sha256.New, secret)
+	}
+	return sha256.New()
+}
+
+// secretKeyID returns an identifier of the given key, which does not reveal
+// the key.
+func secretKeyID(secret []byte) []byte {
+	h := newHash(secret)
+	h.Write([]byte("immcache key"))
+	return h.Sum(nil)
+}
+
+// previousSecret returns the previous key with the given identifier.
+func (c *DiskCache) previousSecret(keyID []byte) ([]byte, bool) {
+	for _, secret := range c.prevSecrets {
+		if hmac.Equal(secretKeyID(secret), keyID) {
+			return secret, true
+		}
+	}
+	return nil, false
+}
+
+// pendingEntry is an entry of a journal written under a previous key, waiting
+// for its file to be re-keyed.
+type pendingEntry struct {
+	key    string
+	entry  diskEntry
+	secret []byte
+}
+
+// pendingEntries returns the entries of a journal written under the given
+// previous key by their sum, from the least recently used.
+func pendingEntries(entries *LRU, prev []byte) map[string][]pendingEntry {
+	pending := make(map[string][]pendingEntry)
+	for e := entries.l.Back(); e != nil; e = e.Prev() {
+		ent := e.Value.(*lruEntry)
+		entry := ent.v.(diskEntry)
+		pending[string(entry.sum)] = append(pending[string(entry.sum)], pendingEntry{ent.k, entry, prev})
+	}
+	return pending
+}
+
+// restorePendingLocked restores the pending entries referencing the file of the
+// given previous sum, re-keyed with its sum under the current key. The entries
+// whose metadata does not match its sum under their key are dropped.
+func (c *DiskCache) restorePendingLocked(prevSum, sum []byte, size int64) {
+	pending := c.pending[string(prevSum)]
+	delete(c.pending, string(prevSum))
+	for _, p := range pending {
+		entry := p.entry
+		if entry.size != size {
+			continue
+		}
+		if entry.meta != nil && !hmac.Equal(metadataSum(newHash(p.secret), entry.sum, entry.meta), entry.metaSum) {
+			continue
+		}
+		if _, ok := c.index.Get(p.key); ok {
+			// the key has been loaded again in the meantime.
+			continue
+		}
+		entry.sum = sum
+		if entry.meta != nil {
+			entry.metaSum = metadataSum(c.hash(), entry.sum, entry.meta)
+		}
+		c.retainLocked(entry)
+		c.index.Set(p.key, entry)
+		if c.jrnl != nil {
+			c.journalErrLocked(c.jrnl.set(p.key, entry))
+		}
+	}
+}
+
+// sumFileKeys returns the sums of the given file under the current key,
+// followed by its sums under the given previous keys.
+func (c *DiskCache) sumFileKeys(filename string, prev [][]byte) ([][]byte, error) {
+	f, err := c.fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hs := []hash.Hash{c.hash()}
+	ws := []io.Writer{hs[0]}
+	for _, secret := range prev {
+		h := newHash(secret)
+		hs, ws = append(hs, h), append(ws, h)
+	}
+	if _, err = io.Copy(io.MultiWriter(ws...), f); err != nil {
+		return nil, err
+	}
+	sums := make([][]byte, len(hs))
+	for i, h := range hs {
+		sums[i] = h.Sum(nil)
+	}
+	return sums, nil
+}
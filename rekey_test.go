@@ -0,0 +1,104 @@
+package immcache
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskCacheRekey(t *testing.T) {
+	secret1, secret2 := []byte("secret1"), []byte("secret2")
+	keys := []string{"0", "1", "2", "48"} // "0" and "48" share the same content
+
+	for _, test := range []struct {
+		name    string
+		persist bool
+		offline bool
+		old     DiskCacheOptions
+		new     DiskCacheOptions
+	}{
+		{"journal", true, false, DiskCacheOptions{Secret: secret1}, DiskCacheOptions{Secret: secret2, PreviousSecrets: [][]byte{[]byte("other"), secret1}}},
+		{"orphans", false, false, DiskCacheOptions{Secret: secret1}, DiskCacheOptions{Secret: secret2, PreviousSecrets: [][]byte{secret1}}},
+		{"from unkeyed", true, false, DiskCacheOptions{HashMode: HashUnkeyed}, DiskCacheOptions{Secret: secret2, PreviousSecrets: [][]byte{nil}}},
+		{"offline", true, true, DiskCacheOptions{Secret: secret1}, DiskCacheOptions{Secret: secret2, PreviousSecrets: [][]byte{secret1}}},
+	} {
+		basePath, err := ioutil.TempDir("", "cozy-rekey-test")
+		if !assert.NoError(t, err) {
+			return
+		}
+		var loads int
+		loader := FuncMetadataLoader(func(_ context.Context, key string) (int64, *Metadata, io.ReadCloser, error) {
+			loads++
+			size, rc, err := faultLoader(key)
+			return size, &Metadata{ETag: strconv.Quote(key)}, rc, err
+		})
+		get := func(c *DiskCache, key string) {
+			rc, meta, err := c.GetOrLoadMetadata(context.Background(), key, loader)
+			if !assert.NoError(t, err, test.name) {
+				return
+			}
+			b, err := ioutil.ReadAll(rc)
+			assert.NoError(t, err, test.name)
+			assert.NoError(t, rc.Close(), test.name)
+			assert.Equal(t, faultContent(key), b, test.name)
+			if assert.NotNil(t, meta, test.name) {
+				assert.Equal(t, strconv.Quote(key), meta.ETag, test.name)
+			}
+		}
+
+		opts := test.old
+		opts.BasePath, opts.PersistIndex = basePath, test.persist
+		cache := NewDiskCache(LRUIndex(), opts)
+		var oldFilenames []string
+		for _, key := range keys {
+			get(cache, key)
+			entry, _ := cache.get(key)
+			oldFilenames = append(oldFilenames, cache.getFilename(entry.sum))
+		}
+		size := cache.size
+		assert.NoError(t, cache.Close())
+
+		// a file written under an unknown key is removed
+		unknown := filepath.Join(basePath, "ff", strings.Repeat("0", 30))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(unknown), 0700))
+		assert.NoError(t, ioutil.WriteFile(unknown, faultContent("1"), 0600))
+
+		opts = test.new
+		opts.BasePath, opts.PersistIndex = basePath, test.persist
+		if test.offline {
+			assert.NoError(t, Rekey(opts))
+			opts.PreviousSecrets = nil
+		}
+		cache = NewDiskCache(LRUIndex(), opts)
+		assert.True(t, cache.init())
+		<-cache.verified
+		assert.Equal(t, size, cache.size, test.name)
+		for _, filename := range append(oldFilenames, unknown) {
+			_, err = os.Stat(filename)
+			assert.True(t, os.IsNotExist(err), test.name)
+		}
+		if !test.persist {
+			assert.Len(t, cache.orphans, len(keys)-1, test.name)
+		}
+		for _, key := range keys {
+			get(cache, key)
+		}
+		if test.persist {
+			assert.Equal(t, len(keys), loads, test.name)
+		} else {
+			assert.Equal(t, 2*len(keys), loads, test.name)
+			assert.Len(t, cache.orphans, 0, test.name)
+		}
+		assert.Equal(t, size, cache.size, test.name)
+		checkDiskCache(t, cache)
+		assert.NoError(t, cache.PurgeAndClose())
+		os.RemoveAll(basePath)
+	}
+}
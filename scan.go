@@ -0,0 +1,157 @@
+package immcache
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// scanBasePath walks the base directory left by a previous instance of the
+// cache to clean it and recompute the size of the cache:
+//
+//   - the temporary files of loads that were interrupted by a crash are
+//     removed. They are recognized by their prefix: the other files of the
+//     base directory are left untouched, like the files of the hexadecimal
+//     directories not named after a sum,
+//   - when the index was restored, the files it does not reference are not
+//     reachable and are removed. So are all the files when the sums use a
+//     new random key and no previous key: none of them can match its name,
+//     and they are removed without being read,
+//   - otherwise the files are kept as orphans, counted in the size of the
+//     cache, until they are evicted or associated to a key by a load with the
+//     same content. Their content is not read by the scan: the returned
+//     orphans are to be verified by verifyOrphans.
+func (c *DiskCache) scanBasePath(restored bool) (orphans []string) {
+	dirs, err := c.fs.ReadDir(c.basePath)
+	if err != nil {
+		return
+	}
+	discard := restored || (c.hashMode() == HashKeyedRandom && len(c.prevSecrets) == 0)
+	var referenced map[string]bool
+	if restored {
+		referenced = make(map[string]bool, len(c.blobs))
+		for sum := range c.blobs {
+			referenced[c.getFilename([]byte(sum))] = true
+		}
+	}
+	for _, dir := range dirs {
+		dirname := filepath.Join(c.basePath, dir.Name())
+		if !dir.IsDir() {
+			if strings.HasPrefix(dir.Name(), tempPrefix) {
+				c.fs.Remove(dirname)
+			}
+			continue
+		}
+		if !isHexName(dir.Name(), 2) {
+			continue
+		}
+		files, err := c.fs.ReadDir(dirname)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			filename := filepath.Join(dirname, file.Name())
+			if file.IsDir() {
+				continue
+			}
+			if !isHexName(file.Name(), 30) {
+				continue
+			}
+			if discard {
+				if !referenced[filename] {
+					c.fs.Remove(filename)
+				}
+				continue
+			}
+			if c.orphans == nil {
+				c.orphans = make(map[string]int64)
+			}
+			c.orphans[filename] = file.Size()
+			c.size += file.Size()
+			orphans = append(orphans, filename)
+		}
+	}
+	return
+}
+
+// verifyOrphans checks the content of the given orphans against their names,
+// outside of the lock since it reads them entirely. The corrupted files are
+// removed, and the files written under a previous key are renamed after their
+// sum under the current key, restoring the pending entries referencing them.
+// done is closed once the orphans are verified, or the cache closed.
+func (c *DiskCache) verifyOrphans(filenames []string, done chan<- struct{}) {
+	defer close(done)
+	for _, filename := range filenames {
+		c.mu.Lock()
+		_, ok := c.orphans[filename]
+		state := atomic.LoadUint32(&c.state)
+		c.mu.Unlock()
+		if state != inited {
+			return
+		}
+		if !ok {
+			continue
+		}
+		sums, err := c.sumFileKeys(filename, c.prevSecrets)
+		c.mu.Lock()
+		if err == nil || os.IsNotExist(err) {
+			c.verifyOrphanLocked(filename, sums)
+		}
+		c.mu.Unlock()
+	}
+	c.mu.Lock()
+	c.pending = nil
+	c.mu.Unlock()
+}
+
+// verifyOrphanLocked checks the orphan of the given filename against its sums
+// under the current key, followed by its sums under the previous keys.
+func (c *DiskCache) verifyOrphanLocked(filename string, sums [][]byte) {
+	size, ok := c.orphans[filename]
+	if !ok || atomic.LoadUint32(&c.state) != inited {
+		// the orphan has been evicted or replaced by a load in the meantime.
+		return
+	}
+	if len(sums) > 0 && c.getFilename(sums[0]) == filename {
+		return
+	}
+	delete(c.orphans, filename)
+	for i := 1; i < len(sums); i++ {
+		if c.getFilename(sums[i]) != filename {
+			continue
+		}
+		// the file was written under a previous key.
+		err := c.rename(filename, sums[0])
+		if err == nil {
+			c.orphans[c.getFilename(sums[0])] = size
+		} else if !os.IsExist(err) {
+			break
+		} else {
+			// the same content is already stored under the current key.
+			c.fs.Remove(filename)
+			c.size -= size
+		}
+		c.restorePendingLocked(sums[i], sums[0], size)
+		return
+	}
+	c.fs.Remove(filename)
+	c.size -= size
+}
+
+func (c *DiskCache) sumFile(filename string) ([]byte, error) {
+	sums, err := c.sumFileKeys(filename, nil)
+	if err != nil {
+		return nil, err
+	}
+	return sums[0], nil
+}
+
+func isHexName(name string, l int) bool {
+	if len(name) != l {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
@@ -0,0 +1,188 @@
+package immcache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const defaultScrubInterval = 24 * time.Hour
+
+// scrubRoutine runs a pass of the scrubber every ScrubInterval, until stop is
+// closed.
+func (c *DiskCache) scrubRoutine(stop <-chan struct{}) {
+	interval := c.opts.ScrubInterval
+	if interval <= 0 {
+		interval = defaultScrubInterval
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-stop:
+			return
+		}
+		start := time.Now()
+		if !c.scrub(stop) {
+			return
+		}
+		timer.Reset(interval - time.Since(start))
+	}
+}
+
+// scrub verifies the files referenced by the index against their sums, reading
+// them at the rate ScrubRate. The entries of the corrupted or missing files
+// are removed from the cache. It returns false if the pass was interrupted by
+// the closing of stop or of the cache.
+func (c *DiskCache) scrub(stop <-chan struct{}) bool {
+	c.mu.Lock()
+	if atomic.LoadUint32(&c.state) != inited {
+		c.mu.Unlock()
+		return false
+	}
+	sums := make([]string, 0, len(c.blobs))
+	for sum := range c.blobs {
+		sums = append(sums, sum)
+	}
+	c.mu.Unlock()
+
+	p := &scrubPacer{rate: c.opts.ScrubRate, start: time.Now(), stop: stop}
+	for _, sum := range sums {
+		c.mu.Lock()
+		blob, ok := c.blobs[sum]
+		var size int64
+		if ok {
+			size = blob.size
+		}
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+		chunks, err := c.scrubFile([]byte(sum), size, p)
+		if err == errCacheClosed {
+			return false
+		}
+		if err == errCorruptedCache || os.IsNotExist(err) {
+			c.scrubCorrupted([]byte(sum), blob)
+			continue
+		}
+		if err == nil {
+			c.mu.Lock()
+			if blob, ok := c.blobs[sum]; ok && blob.chunks == nil {
+				blob.chunks = chunks
+			}
+			c.mu.Unlock()
+		}
+	}
+	atomic.AddInt64(&c.stats.scrubRuns, 1)
+	return true
+}
+
+// scrubFile reads the file of the given sum at the pace of p, and returns the
+// sums of its chunks if it matches its sum and size. It returns errCacheClosed
+// if the pass is stopped while waiting.
+func (c *DiskCache) scrubFile(sum []byte, size int64, p *scrubPacer) ([][]byte, error) {
+	f, err := c.fs.Open(c.getFilename(sum))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := c.hash()
+	chunks := newChunkHasher(c.hash)
+	buf := make([]byte, chunkSize)
+	var n int64
+	for {
+		nr, errr := io.ReadFull(f, buf)
+		if nr > 0 {
+			h.Write(buf[:nr])
+			chunks.Write(buf[:nr])
+			n += int64(nr)
+			atomic.AddInt64(&c.stats.scrubbedBytes, int64(nr))
+		}
+		if errw := p.wait(nr); errw != nil {
+			return nil, errw
+		}
+		if errr == io.EOF || errr == io.ErrUnexpectedEOF {
+			break
+		}
+		if errr != nil {
+			return nil, errr
+		}
+		if n > size {
+			break
+		}
+	}
+	if n != size || !hmac.Equal(h.Sum(nil), sum) {
+		return nil, errCorruptedCache
+	}
+	return chunks.Sums(), nil
+}
+
+// scrubPacer paces the reads of a pass of the scrubber at a rate in bytes per
+// second, unlimited if not positive.
+type scrubPacer struct {
+	rate  int64
+	start time.Time
+	n     int64
+	stop  <-chan struct{}
+}
+
+// wait accounts n bytes read and waits until the rate is respected. It returns
+// errCacheClosed if stop is closed.
+func (p *scrubPacer) wait(n int) error {
+	p.n += int64(n)
+	select {
+	case <-p.stop:
+		return errCacheClosed
+	default:
+	}
+	if p.rate <= 0 {
+		return nil
+	}
+	d := time.Duration(float64(p.n)/float64(p.rate)*float64(time.Second)) - time.Since(p.start)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-p.stop:
+		return errCacheClosed
+	}
+}
+
+// scrubCorrupted removes the entries referencing the file of the given sum,
+// along with the file. blob is the file as found when it was scrubbed: if it
+// was removed and committed again since, the new file is left untouched.
+func (c *DiskCache) scrubCorrupted(sum []byte, blob *diskBlob) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if atomic.LoadUint32(&c.state) != inited {
+		return
+	}
+	if c.blobs[string(sum)] != blob {
+		return
+	}
+	atomic.AddInt64(&c.stats.corruptions, 1)
+	var keys []string
+	c.index.Range(func(key string, value interface{}) bool {
+		if bytes.Equal(value.(diskEntry).sum, sum) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		value, _ := c.index.Remove(key)
+		if c.jrnl != nil {
+			c.journalErrLocked(c.jrnl.remove(key))
+		}
+		c.observer.OnCorruption(key)
+		c.releaseLocked(value.(diskEntry))
+	}
+}
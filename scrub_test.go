@@ -0,0 +1,133 @@
+package immcache
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskCacheScrub(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "cozy-scrub-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(basePath)
+
+	observer := &recordObserver{}
+	opts := DiskCacheOptions{
+		BasePath:     basePath,
+		HashMode:     HashUnkeyed,
+		PersistIndex: true,
+		Observer:     observer,
+	}
+	cache := NewDiskCache(LRUIndex(), opts)
+	keys := []string{"0", "1", "2", "3", "4", "48"} // "0" and "48" share the same content
+	var total int64
+	for _, key := range keys {
+		rc, err := cache.GetOrLoad(key, FuncLoader(faultLoader))
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		if key != "48" {
+			total += int64(len(faultContent(key)))
+		}
+	}
+	filename := func(key string) string {
+		entry, _ := cache.get(key)
+		return cache.getFilename(entry.sum)
+	}
+
+	stop := make(chan struct{})
+	assert.True(t, cache.scrub(stop))
+	assert.Equal(t, int64(1), cache.Stats().ScrubRuns)
+	assert.Equal(t, total, cache.Stats().ScrubbedBytes)
+	assert.Equal(t, int64(0), cache.Stats().Corruptions)
+
+	// a corrupted, a missing and a truncated file
+	corrupted := faultContent("0")
+	corrupted[0] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(filename("0"), corrupted, 0600))
+	assert.NoError(t, os.Remove(filename("1")))
+	assert.NoError(t, ioutil.WriteFile(filename("2"), faultContent("2")[1:], 0600))
+	observer.events = nil
+
+	assert.True(t, cache.scrub(stop))
+	assert.Equal(t, int64(3), cache.Stats().Corruptions)
+	sort.Strings(observer.events)
+	assert.Equal(t, []string{"corruption 0", "corruption 1", "corruption 2", "corruption 48"}, observer.events)
+	for _, key := range keys {
+		_, ok := cache.get(key)
+		assert.Equal(t, key == "3" || key == "4", ok, key)
+	}
+	assert.Equal(t, int64(len(faultContent("3"))+len(faultContent("4"))), cache.size)
+
+	// a file committed again after being scrubbed is kept
+	entry, _ := cache.get("3")
+	scrubbed := cache.blobs[string(entry.sum)]
+	assert.NoError(t, cache.Delete("3"))
+	rc, err := cache.GetOrLoad("3", FuncLoader(faultLoader))
+	if assert.NoError(t, err) {
+		_, err = ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+	}
+	cache.scrubCorrupted(entry.sum, scrubbed)
+	_, ok := cache.get("3")
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), cache.Stats().Corruptions)
+	checkDiskCache(t, cache)
+	assert.NoError(t, cache.Close())
+
+	// the removals are journaled
+	cache = NewDiskCache(LRUIndex(), opts)
+	defer cache.PurgeAndClose()
+	assert.True(t, cache.init())
+	assert.Equal(t, 2, cache.Stats().Entries)
+
+	// the scrubber is paced by its rate, and can be stopped
+	cache.opts.ScrubRate = 2 * cache.size
+	start := time.Now()
+	assert.True(t, cache.scrub(stop))
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+	cache.opts.ScrubRate = 1
+	close(stop)
+	start = time.Now()
+	assert.False(t, cache.scrub(stop))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestDiskCacheScrubRoutine(t *testing.T) {
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-scrub-test",
+		ScrubRate:      1 << 20,
+		ScrubInterval:  10 * time.Millisecond,
+	})
+	defer cache.PurgeAndClose()
+
+	var size int64
+	for i := 0; i < 4; i++ {
+		key := strconv.Itoa(i)
+		rc, err := cache.GetOrLoad(key, FuncLoader(faultLoader))
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		size += int64(len(faultContent(key)))
+	}
+	for i := 0; i < 100 && cache.Stats().ScrubRuns < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, cache.Stats().ScrubRuns >= 3)
+	assert.True(t, cache.Stats().ScrubbedBytes >= 3*size)
+}
@@ -0,0 +1,257 @@
+package immcache
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// chunkSize is the size of the chunks whose sums are used to check the
+// integrity of the random accesses to the cached files.
+const chunkSize = 64 << 10
+
+// ErrNotCached is returned by OpenSeeker when the key is not cached.
+var ErrNotCached = errors.New("immcache: not cached")
+
+var errNegativeOffset = errors.New("immcache: negative offset")
+
+// ReadSeekCloser is a cached content allowing random accesses.
+type ReadSeekCloser interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+}
+
+// OpenSeeker returns a seekable view on the cached content of the given key,
+// for instance to serve range requests, or ErrNotCached if the key is not
+// cached. Unlike the reader returned by GetOrLoad, the integrity of the
+// content is checked chunk by chunk, before returning their bytes.
+//
+// The sums of the chunks are computed when the content is loaded. For the
+// entries restored after a restart, they are computed by a full read of the
+// file the first time it is opened.
+func (c *DiskCache) OpenSeeker(ctx context.Context, key string) (ReadSeekCloser, error) {
+	if atomic.LoadUint32(&c.state) != inited {
+		return nil, ErrNotCached
+	}
+	var chunks [][]byte
+	c.mu.Lock()
+	entry, ok := c.get(key)
+	if blob, okb := c.blobs[string(entry.sum)]; ok && okb {
+		chunks = blob.chunks
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, ErrNotCached
+	}
+
+	filename := c.getFilename(entry.sum)
+	f, err := c.fs.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, ErrNotCached
+	}
+	if err != nil {
+		return nil, err
+	}
+	if chunks == nil {
+		if chunks, err = c.sumChunks(key, entry, f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	atomic.AddInt64(&c.stats.hits, 1)
+	c.observer.OnHit(ctx, key)
+	return &diskSeeker{
+		f:      f,
+		sum:    entry.sum,
+		size:   entry.size,
+		meta:   entry.meta,
+		chunks: chunks,
+		key:    key,
+		c:      c,
+		bufIdx: -1,
+	}, nil
+}
+
+// sumChunks checks the integrity of the given file and computes the sums of
+// its chunks, kept with its blob.
+func (c *DiskCache) sumChunks(key string, entry diskEntry, f File) ([][]byte, error) {
+	h := c.hash()
+	chunks := newChunkHasher(c.hash)
+	n, err := io.Copy(io.MultiWriter(h, chunks), io.NewSectionReader(f, 0, entry.size+1))
+	if err != nil {
+		return nil, err
+	}
+	if n != entry.size || !hmac.Equal(h.Sum(nil), entry.sum) {
+		c.corruptedFile(key, f.Name())
+		return nil, errCorruptedCache
+	}
+	sums := chunks.Sums()
+	c.mu.Lock()
+	if blob, ok := c.blobs[string(entry.sum)]; ok && blob.chunks == nil {
+		blob.chunks = sums
+	}
+	c.mu.Unlock()
+	return sums, nil
+}
+
+// corruptedFile removes a file whose content does not match its sum.
+func (c *DiskCache) corruptedFile(key, filename string) {
+	atomic.AddInt64(&c.stats.corruptions, 1)
+	c.observer.OnCorruption(key)
+	c.fs.Remove(filename)
+}
+
+// diskSeeker reads a cached file by chunks, checking each one of them against
+// its sum. The last chunk read is kept in memory for the next reads.
+type diskSeeker struct {
+	f      File
+	sum    []byte
+	size   int64
+	meta   []byte
+	chunks [][]byte
+	off    int64 // offset of Read and Seek
+
+	mu     sync.Mutex // for the concurrent calls of ReadAt
+	buf    []byte
+	bufIdx int
+
+	key string
+	c   *DiskCache
+}
+
+func (s *diskSeeker) Read(p []byte) (n int, err error) {
+	n, err = s.ReadAt(p, s.off)
+	s.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return
+}
+
+func (s *diskSeeker) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n < len(p) {
+		if off >= s.size {
+			return n, io.EOF
+		}
+		i := int(off / chunkSize)
+		if err = s.readChunkLocked(i); err != nil {
+			return
+		}
+		m := copy(p[n:], s.buf[off-int64(i)*chunkSize:])
+		n += m
+		off += int64(m)
+	}
+	return
+}
+
+func (s *diskSeeker) readChunkLocked(i int) error {
+	if s.bufIdx == i {
+		return nil
+	}
+	s.bufIdx = -1
+	if i >= len(s.chunks) {
+		s.c.corruptedFile(s.key, s.f.Name())
+		return errCorruptedCache
+	}
+	l := s.size - int64(i)*chunkSize
+	if l > chunkSize {
+		l = chunkSize
+	}
+	if s.buf == nil {
+		s.buf = make([]byte, chunkSize)
+	}
+	s.buf = s.buf[:l]
+	n, err := s.f.ReadAt(s.buf, int64(i)*chunkSize)
+	if n < len(s.buf) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	h := s.c.hash()
+	h.Write(s.buf)
+	if !hmac.Equal(h.Sum(nil), s.chunks[i]) {
+		s.c.corruptedFile(s.key, s.f.Name())
+		return errCorruptedCache
+	}
+	s.bufIdx = i
+	return nil
+}
+
+func (s *diskSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.off
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("immcache: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	s.off = offset
+	return offset, nil
+}
+
+func (s *diskSeeker) Close() error {
+	return s.f.Close()
+}
+
+// chunkHasher computes the sums of the consecutive chunks of a content.
+type chunkHasher struct {
+	newHash func() hash.Hash
+	h       hash.Hash
+	n       int // number of bytes written in the current chunk
+	sums    [][]byte
+}
+
+func newChunkHasher(newHash func() hash.Hash) *chunkHasher {
+	return &chunkHasher{newHash: newHash}
+}
+
+func (w *chunkHasher) Write(p []byte) (int, error) {
+	l := len(p)
+	for len(p) > 0 {
+		if w.h == nil {
+			w.h, w.n = w.newHash(), 0
+		}
+		m := chunkSize - w.n
+		if m > len(p) {
+			m = len(p)
+		}
+		w.h.Write(p[:m])
+		w.n += m
+		p = p[m:]
+		if w.n == chunkSize {
+			w.sums = append(w.sums, w.h.Sum(nil))
+			w.h = nil
+		}
+	}
+	return l, nil
+}
+
+// Sums returns the sums of the chunks written, including the last partial
+// one.
+func (w *chunkHasher) Sums() [][]byte {
+	sums := w.sums
+	if w.h != nil {
+		sums = append(sums, w.h.Sum(nil))
+	}
+	if sums == nil {
+		sums = [][]byte{}
+	}
+	return sums
+}
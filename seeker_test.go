@@ -0,0 +1,93 @@
+package immcache
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskCacheSeeker(t *testing.T) {
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-seeker-test",
+		DiskSizeMax:    1 << 30,
+	})
+	defer cache.PurgeAndClose()
+
+	content := make([]byte, 3*chunkSize+1234)
+	rand.New(rand.NewSource(42)).Read(content)
+
+	ctx := context.Background()
+	_, err := cache.OpenSeeker(ctx, "key")
+	assert.Equal(t, ErrNotCached, err)
+
+	rc, err := cache.GetOrLoad("key", bytesLoader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+
+	check := func(rs ReadSeekCloser) {
+		b := make([]byte, 100)
+		for _, off := range []int64{0, chunkSize - 50, 2*chunkSize + 10, int64(len(content)) - 100} {
+			n, err := rs.ReadAt(b, off)
+			assert.NoError(t, err)
+			assert.Equal(t, content[off:off+int64(n)], b[:n])
+		}
+		n, err := rs.ReadAt(b, int64(len(content))-10)
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, 10, n)
+
+		off, err := rs.Seek(-chunkSize, io.SeekEnd)
+		assert.NoError(t, err)
+		rest, err := ioutil.ReadAll(rs)
+		assert.NoError(t, err)
+		assert.Equal(t, content[off:], rest)
+
+		_, err = rs.Seek(0, io.SeekStart)
+		assert.NoError(t, err)
+		all, err := ioutil.ReadAll(rs)
+		assert.NoError(t, err)
+		assert.Equal(t, content, all)
+	}
+
+	rs, err := cache.OpenSeeker(ctx, "key")
+	if assert.NoError(t, err) {
+		check(rs)
+		assert.NoError(t, rs.Close())
+	}
+
+	// the sums of the chunks of a restored entry are computed on open
+	entry, _ := cache.lookup("key")
+	cache.blobs[string(entry.sum)].chunks = nil
+	rs, err = cache.OpenSeeker(ctx, "key")
+	if assert.NoError(t, err) {
+		check(rs)
+		assert.NoError(t, rs.Close())
+	}
+	assert.Len(t, cache.blobs[string(entry.sum)].chunks, 4)
+
+	// a corrupted chunk is detected without reading the whole file
+	corrupted := append([]byte(nil), content...)
+	corrupted[2*chunkSize+1] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(cache.getFilename(entry.sum), corrupted, 0600))
+	rs, err = cache.OpenSeeker(ctx, "key")
+	if assert.NoError(t, err) {
+		b := make([]byte, 10)
+		_, err = rs.ReadAt(b, 0)
+		assert.NoError(t, err)
+		_, err = rs.ReadAt(b, 2*chunkSize)
+		assert.Equal(t, errCorruptedCache, err)
+		assert.NoError(t, rs.Close())
+	}
+	assert.Equal(t, int64(1), cache.Stats().Corruptions)
+	_, err = cache.OpenSeeker(ctx, "key")
+	assert.Equal(t, ErrNotCached, err)
+}
@@ -0,0 +1,67 @@
+package immcache
+
+import "sync/atomic"
+
+// DiskCacheStats contains statistics about a DiskCache. The counters are
+// cumulated since the initialization of the cache.
+type DiskCacheStats struct {
+	Hits        int64 // number of calls served from the disk
+	Misses      int64 // number of loads started to populate the cache
+	Coalesced   int64 // number of calls joining an in-flight load of the same key
+	LoadErrors  int64 // number of errors returned by the loader
+	Corruptions int64 // number of corrupted files detected when read or scrubbed
+
+	EvictionRuns   int64
+	EvictedEntries int64
+	EvictedBytes   int64
+
+	ScrubRuns     int64 // number of complete passes of the scrubber
+	ScrubbedBytes int64 // number of bytes read by the scrubber
+
+	Size     int64 // number of bytes stored on the disk
+	SizeMax  int64
+	Entries  int // number of keys in the index
+	InFlight int // number of in-flight loads
+
+	NegativeEntries int   // number of loader errors cached
+	NegativeHits    int64 // number of calls answered by a cached loader error
+}
+
+// diskStats are the counters of a DiskCache, updated atomically.
+type diskStats struct {
+	hits           int64
+	misses         int64
+	coalesced      int64
+	loadErrors     int64
+	corruptions    int64
+	evictionRuns   int64
+	evictedEntries int64
+	evictedBytes   int64
+	scrubRuns      int64
+	scrubbedBytes  int64
+	negativeHits   int64
+}
+
+// Stats returns the current statistics of the cache.
+func (c *DiskCache) Stats() (s DiskCacheStats) {
+	s.Hits = atomic.LoadInt64(&c.stats.hits)
+	s.Misses = atomic.LoadInt64(&c.stats.misses)
+	s.Coalesced = atomic.LoadInt64(&c.stats.coalesced)
+	s.LoadErrors = atomic.LoadInt64(&c.stats.loadErrors)
+	s.Corruptions = atomic.LoadInt64(&c.stats.corruptions)
+	s.EvictionRuns = atomic.LoadInt64(&c.stats.evictionRuns)
+	s.EvictedEntries = atomic.LoadInt64(&c.stats.evictedEntries)
+	s.EvictedBytes = atomic.LoadInt64(&c.stats.evictedBytes)
+	s.ScrubRuns = atomic.LoadInt64(&c.stats.scrubRuns)
+	s.ScrubbedBytes = atomic.LoadInt64(&c.stats.scrubbedBytes)
+	s.NegativeHits = atomic.LoadInt64(&c.stats.negativeHits)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.Size = c.size
+	s.SizeMax = c.sizeMax
+	s.Entries = c.count
+	s.InFlight = len(c.calls)
+	s.NegativeEntries = len(c.negatives)
+	return
+}
@@ -0,0 +1,116 @@
+package immcache
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Storage is the file system on which a DiskCache stores its files. The
+// errors returned for missing or already existing files must satisfy
+// os.IsNotExist and os.IsExist, like the ones of the os package.
+//
+// A file remains readable through the handles opened on it after being
+// renamed or removed.
+type Storage interface {
+	// MkdirAll creates a directory along with its parents.
+	MkdirAll(path string) error
+	// TempDir creates a new directory in dir whose name begins with prefix.
+	TempDir(dir, prefix string) (string, error)
+	// ReadDir returns the entries of a directory sorted by name. It is used
+	// to walk the base directory at initialization.
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	// Stat returns the information of a file.
+	Stat(name string) (os.FileInfo, error)
+
+	// Open opens a file for reading.
+	Open(name string) (File, error)
+	// OpenAppend opens a file for appending, creating it if necessary.
+	OpenAppend(name string) (File, error)
+	// CreateTemp creates a new file in dir whose name starts with prefix,
+	// opened for writing. Once written, it is moved to its destination with a
+	// rename.
+	CreateTemp(dir, prefix string) (File, error)
+
+	// Rename moves a file, replacing the destination if it exists.
+	Rename(oldpath, newpath string) error
+	// RenameExclusive moves a file, failing with an error satisfying
+	// os.IsExist if the destination exists.
+	RenameExclusive(oldpath, newpath string) error
+	// Remove removes a file or an empty directory.
+	Remove(name string) error
+	// RemoveAll removes a directory and its content.
+	RemoveAll(path string) error
+}
+
+// File is a file opened on a Storage.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Name() string
+	Sync() error
+}
+
+// OSStorage is the Storage of the local file system, used by default.
+type OSStorage struct{}
+
+func (OSStorage) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0700)
+}
+
+func (OSStorage) TempDir(dir, prefix string) (string, error) {
+	return ioutil.TempDir(dir, prefix)
+}
+
+func (OSStorage) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+func (OSStorage) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSStorage) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (OSStorage) OpenAppend(name string) (File, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+func (OSStorage) CreateTemp(dir, prefix string) (File, error) {
+	return ioutil.TempFile(dir, prefix)
+}
+
+func (OSStorage) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSStorage) RenameExclusive(oldpath, newpath string) error {
+	// make sure we cannot concurrently create the same file: the destination
+	// is reserved by creating it exclusively before being replaced.
+	f, err := os.OpenFile(newpath, os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err == nil {
+		err = os.Rename(oldpath, newpath)
+	}
+	if err != nil {
+		os.Remove(newpath)
+	}
+	return err
+}
+
+func (OSStorage) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSStorage) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+var _ Storage = OSStorage{}
@@ -0,0 +1,361 @@
+package immcache
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemStorage is a Storage keeping its files in memory, for instance to test a
+// DiskCache without touching the disk. Its zero value is an empty storage
+// ready to use.
+type MemStorage struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]time.Time
+	seq   int
+}
+
+// NewMemStorage returns an empty MemStorage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{}
+}
+
+type memNode struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func (s *MemStorage) lazyInit() {
+	if s.files == nil {
+		s.files = make(map[string]*memNode)
+		s.dirs = map[string]time.Time{".": {}, string(filepath.Separator): {}}
+	}
+}
+
+// hasDirLocked returns whether the given directory exists. The current and
+// root directories always exist.
+func (s *MemStorage) hasDirLocked(dir string) bool {
+	_, ok := s.dirs[dir]
+	return ok
+}
+
+func (s *MemStorage) MkdirAll(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lazyInit()
+	path = filepath.Clean(path)
+	if _, ok := s.files[path]; ok {
+		return &os.PathError{Op: "mkdir", Path: path, Err: os.ErrExist}
+	}
+	for dir := path; !s.hasDirLocked(dir); dir = filepath.Dir(dir) {
+		s.dirs[dir] = time.Now()
+	}
+	return nil
+}
+
+func (s *MemStorage) TempDir(dir, prefix string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lazyInit()
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	dir = filepath.Clean(dir)
+	for d := dir; !s.hasDirLocked(d); d = filepath.Dir(d) {
+		s.dirs[d] = time.Now()
+	}
+	name := s.tempNameLocked(dir, prefix)
+	s.dirs[name] = time.Now()
+	return name, nil
+}
+
+func (s *MemStorage) tempNameLocked(dir, prefix string) string {
+	for {
+		s.seq++
+		name := filepath.Join(dir, prefix+strconv.Itoa(s.seq))
+		if _, ok := s.files[name]; ok {
+			continue
+		}
+		if s.hasDirLocked(name) {
+			continue
+		}
+		return name
+	}
+}
+
+func (s *MemStorage) ReadDir(dirname string) ([]os.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lazyInit()
+	dirname = filepath.Clean(dirname)
+	if !s.hasDirLocked(dirname) {
+		return nil, &os.PathError{Op: "open", Path: dirname, Err: os.ErrNotExist}
+	}
+	var infos []os.FileInfo
+	for name, n := range s.files {
+		if filepath.Dir(name) == dirname {
+			infos = append(infos, n.stat(name))
+		}
+	}
+	for name, modTime := range s.dirs {
+		if name != dirname && filepath.Dir(name) == dirname {
+			infos = append(infos, memFileInfo{name: filepath.Base(name), modTime: modTime, dir: true})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (s *MemStorage) Stat(name string) (os.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lazyInit()
+	name = filepath.Clean(name)
+	if n, ok := s.files[name]; ok {
+		return n.stat(name), nil
+	}
+	if modTime, ok := s.dirs[name]; ok {
+		return memFileInfo{name: filepath.Base(name), modTime: modTime, dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (s *MemStorage) Open(name string) (File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lazyInit()
+	name = filepath.Clean(name)
+	n, ok := s.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFile{name: name, n: n, read: true}, nil
+}
+
+func (s *MemStorage) OpenAppend(name string) (File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lazyInit()
+	name = filepath.Clean(name)
+	n, ok := s.files[name]
+	if !ok {
+		if !s.hasDirLocked(filepath.Dir(name)) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		n = &memNode{modTime: time.Now()}
+		s.files[name] = n
+	}
+	return &memFile{name: name, n: n, write: true, append: true}, nil
+}
+
+func (s *MemStorage) CreateTemp(dir, prefix string) (File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lazyInit()
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	dir = filepath.Clean(dir)
+	if !s.hasDirLocked(dir) {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	name := s.tempNameLocked(dir, prefix)
+	n := &memNode{modTime: time.Now()}
+	s.files[name] = n
+	return &memFile{name: name, n: n, write: true}, nil
+}
+
+func (s *MemStorage) Rename(oldpath, newpath string) error {
+	return s.rename(oldpath, newpath, false)
+}
+
+func (s *MemStorage) RenameExclusive(oldpath, newpath string) error {
+	return s.rename(oldpath, newpath, true)
+}
+
+func (s *MemStorage) rename(oldpath, newpath string, exclusive bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lazyInit()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	n, ok := s.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if !s.hasDirLocked(filepath.Dir(newpath)) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if _, exists := s.files[newpath]; (exists && exclusive) || s.hasDirLocked(newpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrExist}
+	}
+	delete(s.files, oldpath)
+	s.files[newpath] = n
+	return nil
+}
+
+func (s *MemStorage) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lazyInit()
+	name = filepath.Clean(name)
+	if _, ok := s.files[name]; ok {
+		delete(s.files, name)
+		return nil
+	}
+	if !s.hasDirLocked(name) {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	for child := range s.files {
+		if filepath.Dir(child) == name {
+			return &os.PathError{Op: "remove", Path: name, Err: os.ErrExist}
+		}
+	}
+	for child := range s.dirs {
+		if child != name && filepath.Dir(child) == name {
+			return &os.PathError{Op: "remove", Path: name, Err: os.ErrExist}
+		}
+	}
+	delete(s.dirs, name)
+	return nil
+}
+
+func (s *MemStorage) RemoveAll(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lazyInit()
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	for name := range s.files {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(s.files, name)
+		}
+	}
+	for name := range s.dirs {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(s.dirs, name)
+		}
+	}
+	s.dirs["."], s.dirs[string(filepath.Separator)] = time.Time{}, time.Time{}
+	return nil
+}
+
+func (n *memNode) stat(name string) os.FileInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return memFileInfo{
+		name:    filepath.Base(name),
+		size:    int64(len(n.data)),
+		modTime: n.modTime,
+	}
+}
+
+// memFile is a handle on a file of a MemStorage. It keeps a reference to the
+// content of the file, even after it has been renamed or removed.
+type memFile struct {
+	name   string
+	n      *memNode
+	off    int64
+	read   bool
+	write  bool
+	append bool
+	closed bool
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrClosed}
+	}
+	if !f.read {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrPermission}
+	}
+	f.n.mu.RLock()
+	defer f.n.mu.RUnlock()
+	if off >= int64(len(f.n.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.n.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrClosed}
+	}
+	if !f.write {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	f.n.mu.Lock()
+	defer f.n.mu.Unlock()
+	if f.append {
+		f.off = int64(len(f.n.data))
+	}
+	if end := f.off + int64(len(p)); end > int64(cap(f.n.data)) {
+		data := make([]byte, end, 2*end)
+		copy(data, f.n.data)
+		f.n.data = data
+	} else if end > int64(len(f.n.data)) {
+		f.n.data = f.n.data[:end]
+	}
+	copy(f.n.data[f.off:], p)
+	f.off += int64(len(p))
+	f.n.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
+
+var _ Storage = (*MemStorage)(nil)
@@ -0,0 +1,91 @@
+package immcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorage(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "cozy-storage-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(basePath)
+
+	for name, fs := range map[string]Storage{
+		"os":  OSStorage{},
+		"mem": NewMemStorage(),
+	} {
+		dir, err := fs.TempDir(basePath, "test")
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		assert.NoError(t, fs.MkdirAll(filepath.Join(dir, "a", "b")), name)
+
+		tmp, err := fs.CreateTemp(dir, "tmp")
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		_, err = tmp.Write([]byte("hello"))
+		assert.NoError(t, err, name)
+
+		// a reader follows the writes of the file, even after its removal
+		r, err := fs.Open(tmp.Name())
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		_, err = tmp.Write([]byte(" world"))
+		assert.NoError(t, err, name)
+		assert.NoError(t, tmp.Sync(), name)
+		assert.NoError(t, tmp.Close(), name)
+
+		dst := filepath.Join(dir, "a", "b", "file")
+		assert.NoError(t, fs.RenameExclusive(tmp.Name(), dst), name)
+		b := make([]byte, 5)
+		n, err := r.ReadAt(b, 6)
+		assert.NoError(t, err, name)
+		assert.Equal(t, "world", string(b[:n]), name)
+		assert.NoError(t, r.Close(), name)
+
+		fi, err := fs.Stat(dst)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, int64(11), fi.Size(), name)
+		}
+		_, err = fs.Stat(tmp.Name())
+		assert.True(t, os.IsNotExist(err), name)
+
+		other, err := fs.OpenAppend(filepath.Join(dir, "other"))
+		if assert.NoError(t, err, name) {
+			other.Write([]byte("other"))
+			assert.NoError(t, other.Close(), name)
+		}
+		err = fs.RenameExclusive(filepath.Join(dir, "other"), dst)
+		assert.True(t, os.IsExist(err), name)
+		assert.NoError(t, fs.Rename(filepath.Join(dir, "other"), dst), name)
+		f, err := fs.Open(dst)
+		if assert.NoError(t, err, name) {
+			b, err := ioutil.ReadAll(f)
+			assert.NoError(t, err, name)
+			assert.Equal(t, "other", string(b), name)
+			assert.NoError(t, f.Close(), name)
+		}
+
+		infos, err := fs.ReadDir(dir)
+		if assert.NoError(t, err, name) && assert.Len(t, infos, 1, name) {
+			assert.Equal(t, "a", infos[0].Name(), name)
+			assert.True(t, infos[0].IsDir(), name)
+		}
+
+		assert.Error(t, fs.Remove(filepath.Join(dir, "a")), name)
+		assert.NoError(t, fs.Remove(dst), name)
+		assert.NoError(t, fs.RemoveAll(dir), name)
+		_, err = fs.Open(dst)
+		assert.True(t, os.IsNotExist(err), name)
+		_, err = fs.ReadDir(dir)
+		assert.True(t, os.IsNotExist(err), name)
+	}
+}
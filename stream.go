@@ -0,0 +1,199 @@
+package immcache
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// teeStream shares the progress of a diskTee writing its temporary file with
+// the followers, the callers of the same key reading the content while it is
+// being loaded.
+type teeStream struct {
+	f File // read handle on the temporary file, shared by the followers
+
+	mu        sync.Mutex
+	n         int64 // number of bytes readable from the file
+	err       error // set when the content is known to be incomplete
+	done      bool  // set when the diskTee has finished writing
+	broken    bool  // set when the file cannot be completed by the diskTee
+	closing   bool  // set when the diskTee is closed without followers
+	followers int
+	wake      chan struct{} // closed and renewed on each progress
+}
+
+func newTeeStream(fs Storage, filename string) *teeStream {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return nil
+	}
+	return &teeStream{
+		f:    f,
+		wake: make(chan struct{}),
+	}
+}
+
+// following returns whether or not followers are reading the stream.
+func (s *teeStream) following() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.followers > 0
+}
+
+// drain returns true if the stream has followers, in which case the diskTee
+// should keep on loading the content after being closed. Otherwise the stream
+// does not accept new followers.
+func (s *teeStream) drain() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.followers > 0 {
+		return true
+	}
+	s.closing = true
+	return false
+}
+
+// publish wakes the followers after some progress of the diskTee. The given
+// bytes must have been flushed to the file.
+func (s *teeStream) publish(n int64, err error, done bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.broken {
+		s.n = n
+	}
+	if s.err == nil {
+		s.err = err
+	}
+	s.done = done
+	close(s.wake)
+	s.wake = make(chan struct{})
+	if done && s.followers == 0 {
+		s.f.Close()
+	}
+}
+
+// fail wakes the followers after an error of the cache writing the file, like
+// a full disk. The content is not published anymore: the followers load the
+// rest of the content on their own.
+func (s *teeStream) fail() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.broken {
+		return
+	}
+	s.broken = true
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// follow returns a reader following the stream from its beginning, or false
+// if the stream does not accept new followers. The given load function is
+// used to read the content from the given offset if the stream breaks.
+func (s *teeStream) follow(ctx context.Context, release func(), load func(off int64) (io.ReadCloser, error)) (*diskFollower, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done || s.closing || s.broken {
+		return nil, false
+	}
+	s.followers++
+	return &diskFollower{
+		ctx:     ctx,
+		s:       s,
+		load:    load,
+		release: release,
+	}, true
+}
+
+func (s *teeStream) unfollow() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.followers--
+	if s.done && s.followers == 0 {
+		s.f.Close()
+	}
+}
+
+// diskFollower reads the temporary file of an in-flight load, waiting for the
+// diskTee to write the content. If the stream breaks, the rest of the content
+// is read from a load of its own.
+type diskFollower struct {
+	ctx     context.Context
+	s       *teeStream
+	off     int64
+	load    func(off int64) (io.ReadCloser, error)
+	src     io.ReadCloser // own load, once the stream is broken
+	release func()
+	closed  bool
+}
+
+func (f *diskFollower) Read(p []byte) (n int, err error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.src != nil {
+		return f.src.Read(p)
+	}
+	for {
+		f.s.mu.Lock()
+		size, errs, done, broken, wake := f.s.n, f.s.err, f.s.done, f.s.broken, f.s.wake
+		f.s.mu.Unlock()
+		if f.off < size {
+			if l := size - f.off; int64(len(p)) > l {
+				p = p[:l]
+			}
+			n, err = f.s.f.ReadAt(p, f.off)
+			f.off += int64(n)
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+			return
+		}
+		if broken {
+			if f.src, err = f.load(f.off); err != nil {
+				return 0, err
+			}
+			return f.src.Read(p)
+		}
+		if errs != nil {
+			return 0, errs
+		}
+		if done {
+			return 0, io.EOF
+		}
+		select {
+		case <-wake:
+		case <-f.ctx.Done():
+			return 0, f.ctx.Err()
+		}
+	}
+}
+
+func (f *diskFollower) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	var err error
+	if f.src != nil {
+		err = f.src.Close()
+	}
+	f.s.unfollow()
+	f.release()
+	return err
+}
@@ -0,0 +1,62 @@
+package immcache
+
+import (
+	"io"
+)
+
+// Tiered composes caches into a single Immutable, from the fastest tier to
+// the slowest one, typically a MemoryCache in front of a DiskCache. A key is
+// looked up in each tier in order: on a miss, a tier loads the content from
+// the next ones, the last tier calling the loader. The content found in a
+// lower tier is thus promoted into the upper ones as it is read, each tier
+// keeping on applying its own size limits and eviction.
+type Tiered struct {
+	tiers []Immutable
+}
+
+// NewTiered returns a Tiered cache with the given tiers, from the fastest to
+// the slowest.
+func NewTiered(tiers ...Immutable) *Tiered {
+	return &Tiered{tiers: tiers}
+}
+
+func (t *Tiered) GetOrLoad(key string, loader Loader) (io.ReadCloser, error) {
+	return t.getOrLoad(0, key, loader)
+}
+
+func (t *Tiered) getOrLoad(i int, key string, loader Loader) (io.ReadCloser, error) {
+	if i == len(t.tiers) {
+		_, rc, err := loader.Load(key)
+		return rc, err
+	}
+	if i == len(t.tiers)-1 {
+		return t.tiers[i].GetOrLoad(key, loader)
+	}
+	return t.tiers[i].GetOrLoad(key, FuncLoader(func(key string) (int64, io.ReadCloser, error) {
+		rc, err := t.getOrLoad(i+1, key, loader)
+		// the size of the content is not known by the lower tiers.
+		return -1, rc, err
+	}))
+}
+
+// Delete removes the key from all the tiers, returning the first error.
+func (t *Tiered) Delete(key string) (err error) {
+	for _, tier := range t.tiers {
+		if errd := tier.Delete(key); err == nil {
+			err = errd
+		}
+	}
+	return
+}
+
+// PurgeAndClose purges and closes all the tiers, returning the first error.
+func (t *Tiered) PurgeAndClose() (err error) {
+	for _, tier := range t.tiers {
+		if errp := tier.PurgeAndClose(); err == nil {
+			err = errp
+		}
+	}
+	return
+}
+
+var _ Immutable = (*Tiered)(nil)
@@ -0,0 +1,147 @@
+// Package tracing creates OpenTelemetry spans for the calls of a DiskCache,
+// telling apart the calls served from the disk from the ones loading their
+// content from the origin.
+package tracing
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/jinroh/immcache"
+)
+
+// TracerName is the name of the tracer used to create the spans.
+const TracerName = "github.com/jinroh/immcache/tracing"
+
+// Attributes set on the spans.
+const (
+	KeyAttribute     = attribute.Key("immcache.key")
+	OutcomeAttribute = attribute.Key("immcache.outcome")
+	SizeAttribute    = attribute.Key("immcache.size")
+)
+
+// Outcomes of a call, set as OutcomeAttribute on its span.
+const (
+	OutcomeHit       = "hit"       // served from the disk
+	OutcomeMiss      = "miss"      // loaded from the origin and cached
+	OutcomeCoalesced = "coalesced" // joined an in-flight load of the same key
+	OutcomeBypass    = "bypass"    // loaded from the origin, too large to be cached
+)
+
+// Tracer creates the spans of the calls of a DiskCache. It must be given as
+// the Observer of the cache, and the calls must be made with its
+// GetOrLoadContext method:
+//
+//	tracer := tracing.NewTracer(nil)
+//	cache := immcache.NewDiskCache(index, immcache.DiskCacheOptions{
+//		Observer: tracer,
+//	})
+//	rc, err := tracer.GetOrLoadContext(ctx, cache, key, loader)
+//
+// Each call creates a "immcache.GetOrLoad" span, ended when the returned
+// content is closed, with the outcome of the call. The calls of the loader
+// create a child "immcache.Load" span, and the commit of the loaded content
+// into the cache a child "immcache.Commit" span of the call that started the
+// load.
+type Tracer struct {
+	immcache.NopObserver
+	tracer trace.Tracer
+}
+
+// NewTracer returns a Tracer creating its spans with the given provider. If tp
+// is nil, the global provider is used.
+func NewTracer(tp trace.TracerProvider) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &Tracer{tracer: tp.Tracer(TracerName)}
+}
+
+// GetOrLoad is like GetOrLoadContext with a plain Loader.
+func (t *Tracer) GetOrLoad(ctx context.Context, cache *immcache.DiskCache, key string, loader immcache.Loader) (io.ReadCloser, error) {
+	return t.GetOrLoadContext(ctx, cache, key, immcache.FuncContextLoader(func(_ context.Context, key string) (int64, io.ReadCloser, error) {
+		return loader.Load(key)
+	}))
+}
+
+// GetOrLoadContext calls the GetOrLoadContext method of the cache in a new
+// span.
+func (t *Tracer) GetOrLoadContext(ctx context.Context, cache *immcache.DiskCache, key string, loader immcache.ContextLoader) (io.ReadCloser, error) {
+	ctx, span := t.tracer.Start(ctx, "immcache.GetOrLoad", trace.WithAttributes(KeyAttribute.String(key)))
+	rc, err := cache.GetOrLoadContext(ctx, key, t.wrapLoader(loader))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return nil, err
+	}
+	return &spanCloser{rc, span}, nil
+}
+
+func (t *Tracer) wrapLoader(l immcache.ContextLoader) immcache.ContextLoader {
+	return immcache.FuncContextLoader(func(ctx context.Context, key string) (int64, io.ReadCloser, error) {
+		ctx, span := t.tracer.Start(ctx, "immcache.Load", trace.WithAttributes(KeyAttribute.String(key)))
+		defer span.End()
+		size, rc, err := l.LoadContext(ctx, key)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetAttributes(SizeAttribute.Int64(size))
+		}
+		return size, rc, err
+	})
+}
+
+func (t *Tracer) OnHit(ctx context.Context, key string) {
+	trace.SpanFromContext(ctx).SetAttributes(OutcomeAttribute.String(OutcomeHit))
+}
+
+func (t *Tracer) OnMiss(ctx context.Context, key string) {
+	trace.SpanFromContext(ctx).SetAttributes(OutcomeAttribute.String(OutcomeMiss))
+}
+
+func (t *Tracer) OnCoalesced(ctx context.Context, key string) {
+	trace.SpanFromContext(ctx).SetAttributes(OutcomeAttribute.String(OutcomeCoalesced))
+}
+
+func (t *Tracer) OnBypass(ctx context.Context, key string, size int64) {
+	trace.SpanFromContext(ctx).SetAttributes(OutcomeAttribute.String(OutcomeBypass))
+}
+
+// OnCommit creates the commit span after the fact, from its duration.
+func (t *Tracer) OnCommit(ctx context.Context, key string, size int64, err error, d time.Duration) {
+	end := time.Now()
+	_, span := t.tracer.Start(ctx, "immcache.Commit",
+		trace.WithTimestamp(end.Add(-d)),
+		trace.WithAttributes(KeyAttribute.String(key), SizeAttribute.Int64(size)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+var _ immcache.Observer = (*Tracer)(nil)
+
+// spanCloser ends the span of a call once its content is closed.
+type spanCloser struct {
+	io.ReadCloser
+	span trace.Span
+}
+
+func (s *spanCloser) Close() error {
+	err := s.ReadCloser.Close()
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+	return err
+}
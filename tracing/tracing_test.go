@@ -0,0 +1,71 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jinroh/immcache"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := NewTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	cache := immcache.NewDiskCache(immcache.LRUIndex(), immcache.DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-tracing-test",
+		DiskSizeMax:    1 << 20,
+		EntrySizeMax:   4,
+		Observer:       tracer,
+	})
+	defer cache.PurgeAndClose()
+
+	read := func(key, content string) {
+		loader := immcache.FuncLoader(func(_ string) (int64, io.ReadCloser, error) {
+			return int64(len(content)), ioutil.NopCloser(bytes.NewReader([]byte(content))), nil
+		})
+		rc, err := tracer.GetOrLoad(context.Background(), cache, key, loader)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+	}
+
+	read("a", "toto")
+	read("a", "toto")
+	read("b", "too large")
+
+	spans := recorder.Ended()
+	var names, outcomes []string
+	for _, span := range spans {
+		names = append(names, span.Name())
+		for _, attr := range span.Attributes() {
+			if attr.Key == OutcomeAttribute {
+				outcomes = append(outcomes, attr.Value.AsString())
+			}
+		}
+	}
+	assert.Equal(t, []string{
+		"immcache.Load", "immcache.Commit", "immcache.GetOrLoad",
+		"immcache.GetOrLoad",
+		"immcache.Load", "immcache.GetOrLoad",
+	}, names)
+	assert.Equal(t, []string{OutcomeMiss, OutcomeHit, OutcomeBypass}, outcomes)
+
+	if len(spans) == 6 {
+		parent := spans[2].SpanContext()
+		assert.Equal(t, parent.SpanID(), spans[0].Parent().SpanID())
+		assert.Equal(t, parent.SpanID(), spans[1].Parent().SpanID())
+		assert.Equal(t, parent.TraceID(), spans[1].SpanContext().TraceID())
+		assert.False(t, spans[1].StartTime().After(spans[1].EndTime()))
+	}
+}
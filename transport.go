@@ -0,0 +1,279 @@
+package immcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errTransportCacheable = errors.New("immcache: a transport requires a Cacheable rule")
+
+// Transport is an http.RoundTripper caching the responses of the requests
+// to immutable resources, for instance the URLs with content-hashed paths.
+// The status, headers and body of the responses are stored in the cache, so
+// that the cached responses are replayed as they were received.
+//
+// The requests that are not cacheable, and the responses that are not
+// cacheable, are passed through without touching the cache. The cached
+// responses never expire and are shared by all the requests of the same key:
+// only the GET requests matching the Cacheable rule and carrying no
+// credentials are cached, and the default options do not cache the responses
+// specific to a user or to be revalidated.
+type Transport struct {
+	cache             Immutable
+	transport         http.RoundTripper
+	cacheable         func(req *http.Request) bool
+	cacheableResponse func(res *http.Response) bool
+	key               func(req *http.Request) string
+}
+
+// TransportOptions are the options to create a transport.
+type TransportOptions struct {
+	// Transport is the transport used for the requests missing from the
+	// cache, by default http.DefaultTransport.
+	Transport http.RoundTripper
+
+	// Cacheable returns whether the response of the given request can be
+	// cached. It is required, and must only match the URLs of immutable
+	// resources, like content-hashed paths: the cached responses are never
+	// refreshed. The requests other than GET, and the ones with a Range,
+	// Authorization or Cookie header, are never cached.
+	Cacheable func(req *http.Request) bool
+
+	// CacheableResponse returns whether the given response can be cached. By
+	// default, the responses with a 200 status are cached, unless they set a
+	// cookie, have a private, no-store or no-cache Cache-Control, are already
+	// expired, or vary with the headers of the requests other than an
+	// Accept-Encoding added by the transport.
+	CacheableResponse func(res *http.Response) bool
+
+	// Key returns the key of the cached response of a request, by default its
+	// URL.
+	Key func(req *http.Request) string
+}
+
+// NewTransport returns a transport caching the responses in the given cache.
+// If the cache supports contexts, like a DiskCache, the context of the
+// requests is used to wait for the in-flight requests of the same key. It
+// returns an error if no Cacheable rule is given.
+func NewTransport(cache Immutable, opts TransportOptions) (*Transport, error) {
+	if opts.Cacheable == nil {
+		return nil, errTransportCacheable
+	}
+	t := &Transport{
+		cache:             cache,
+		transport:         opts.Transport,
+		cacheable:         opts.Cacheable,
+		cacheableResponse: opts.CacheableResponse,
+		key:               opts.Key,
+	}
+	if t.transport == nil {
+		t.transport = http.DefaultTransport
+	}
+	if t.cacheableResponse == nil {
+		t.cacheableResponse = defaultCacheableResponse
+	}
+	if t.key == nil {
+		t.key = func(req *http.Request) string {
+			return req.URL.String()
+		}
+	}
+	return t, nil
+}
+
+// shareable returns whether the response of the given request may be shared
+// with the other requests of the same key.
+func shareable(req *http.Request) bool {
+	return req.Method == http.MethodGet &&
+		req.Header.Get("Range") == "" &&
+		req.Header.Get("Authorization") == "" &&
+		req.Header.Get("Cookie") == ""
+}
+
+func defaultCacheableResponse(res *http.Response) bool {
+	if res.StatusCode != http.StatusOK || len(res.Header["Set-Cookie"]) > 0 {
+		return false
+	}
+	var maxAge bool
+	for _, directive := range headerTokens(res.Header, "Cache-Control") {
+		name, value := directive, ""
+		if i := strings.IndexByte(directive, '='); i >= 0 {
+			name, value = directive[:i], strings.Trim(directive[i+1:], `"`)
+		}
+		switch name {
+		case "private", "no-store", "no-cache":
+			return false
+		case "max-age", "s-maxage":
+			if age, err := strconv.Atoi(value); err != nil || age <= 0 {
+				return false
+			}
+			maxAge = true
+		}
+	}
+	// the max-age directive overrides the Expires header.
+	if expires := res.Header.Get("Expires"); expires != "" && !maxAge {
+		if t, err := http.ParseTime(expires); err != nil || !t.After(time.Now()) {
+			return false
+		}
+	}
+	for _, field := range headerTokens(res.Header, "Vary") {
+		if field != "accept-encoding" {
+			return false
+		}
+		if res.Request != nil && res.Request.Header.Get("Accept-Encoding") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// headerTokens returns the lowercased elements of the comma-separated values
+// of the given header.
+func headerTokens(header http.Header, name string) (tokens []string) {
+	for _, value := range header[name] {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.ToLower(strings.TrimSpace(token)); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return
+}
+
+// contextCache is implemented by the caches supporting contexts.
+type contextCache interface {
+	GetOrLoadContext(ctx context.Context, key string, loader ContextLoader) (io.ReadCloser, error)
+}
+
+// uncacheableResponse is returned as a loader error to pass a response that
+// must not be cached to the caller.
+type uncacheableResponse struct {
+	res  *http.Response
+	once sync.Once
+}
+
+func (e *uncacheableResponse) Error() string {
+	return "immcache: uncacheable response " + e.res.Status
+}
+
+// take returns the response to the first caller only: the waiters of the same
+// in-flight load must do their own requests.
+func (e *uncacheableResponse) take() (res *http.Response) {
+	e.once.Do(func() { res = e.res })
+	return
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !shareable(req) || !t.cacheable(req) {
+		return t.transport.RoundTrip(req)
+	}
+	loader := FuncContextLoader(func(ctx context.Context, _ string) (int64, io.ReadCloser, error) {
+		return t.load(req.WithContext(ctx))
+	})
+	var rc io.ReadCloser
+	var err error
+	if cache, ok := t.cache.(contextCache); ok {
+		rc, err = cache.GetOrLoadContext(req.Context(), t.key(req), loader)
+	} else {
+		rc, err = t.cache.GetOrLoad(t.key(req), FuncLoader(func(key string) (int64, io.ReadCloser, error) {
+			return loader(req.Context(), key)
+		}))
+	}
+	if u, ok := err.(*uncacheableResponse); ok {
+		if res := u.take(); res != nil {
+			return res, nil
+		}
+		return t.transport.RoundTrip(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(rc), req)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	res.Body = &replayBody{body: res.Body, rc: rc}
+	return res, nil
+}
+
+// load does the request and serializes its response in the HTTP/1.1 format,
+// without the framing of its body, read until EOF on replay.
+func (t *Transport) load(req *http.Request) (int64, io.ReadCloser, error) {
+	res, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !t.cacheableResponse(res) {
+		return 0, nil, &uncacheableResponse{res: res}
+	}
+	var head bytes.Buffer
+	status := res.Status
+	if !strings.HasPrefix(status, strconv.Itoa(res.StatusCode)+" ") {
+		status = strconv.Itoa(res.StatusCode) + " " + http.StatusText(res.StatusCode)
+	}
+	fmt.Fprintf(&head, "HTTP/1.1 %s\r\n", status)
+	header := res.Header.Clone()
+	for _, h := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Trailer", "Content-Length"} {
+		header.Del(h)
+	}
+	if res.ContentLength >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	}
+	if err = header.Write(&head); err != nil {
+		res.Body.Close()
+		return 0, nil, err
+	}
+	head.WriteString("\r\n")
+	size := int64(-1)
+	if res.ContentLength >= 0 {
+		size = int64(head.Len()) + res.ContentLength
+	}
+	return size, &responseBody{io.MultiReader(&head, res.Body), res.Body}, nil
+}
+
+// responseBody reads a response body, closing the underlying source.
+type responseBody struct {
+	io.Reader
+	src io.Closer
+}
+
+func (b *responseBody) Close() error {
+	return b.src.Close()
+}
+
+// replayBody reads the body of a cached response. Once read entirely, the
+// remaining of the cached content is consumed so that its integrity is
+// checked when closed.
+type replayBody struct {
+	body io.ReadCloser
+	rc   io.ReadCloser
+	eof  bool
+}
+
+func (b *replayBody) Read(p []byte) (n int, err error) {
+	n, err = b.body.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return
+}
+
+func (b *replayBody) Close() error {
+	if b.eof {
+		io.Copy(ioutil.Discard, b.rc)
+	}
+	b.body.Close()
+	return b.rc.Close()
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
@@ -0,0 +1,188 @@
+package immcache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransport(t *testing.T) {
+	var requests int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/assets/app.123.js":
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Header().Set("X-Custom", "value")
+			w.Write([]byte("alert()"))
+		case "/assets/chunked.js":
+			w.(http.Flusher).Flush()
+			w.Write([]byte("chunked"))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer origin.Close()
+
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-transport-test",
+		DiskSizeMax:    1 << 20,
+	})
+	defer cache.PurgeAndClose()
+
+	transport, err := NewTransport(cache, TransportOptions{
+		Cacheable: func(req *http.Request) bool {
+			return req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/assets/")
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	client := &http.Client{Transport: transport}
+
+	get := func(method, path string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, origin.URL+path, nil)
+		res, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, res.Body.Close())
+		return res, string(b)
+	}
+
+	for i := 0; i < 3; i++ {
+		res, body := get("GET", "/assets/app.123.js")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "200 OK", res.Status)
+		assert.Equal(t, "alert()", body)
+		assert.Equal(t, int64(7), res.ContentLength)
+		assert.Equal(t, "application/javascript", res.Header.Get("Content-Type"))
+		assert.Equal(t, "value", res.Header.Get("X-Custom"))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Equal(t, int64(2), cache.Stats().Hits)
+
+	for i := 0; i < 2; i++ {
+		res, body := get("GET", "/assets/chunked.js")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "chunked", body)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// the uncacheable requests and responses are passed through
+	for i := 0; i < 2; i++ {
+		res, body := get("GET", "/assets/missing.js")
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+		assert.Equal(t, "not found\n", body)
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+	get("GET", "/other/app.123.js")
+	get("HEAD", "/assets/app.123.js")
+	assert.Equal(t, int32(6), atomic.LoadInt32(&requests))
+}
+
+func TestTransportDefaults(t *testing.T) {
+	var requests int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/cookie":
+			w.Header().Set("Set-Cookie", "session="+r.Header.Get("Authorization"))
+		case "/no-store":
+			w.Header().Set("Cache-Control", "max-age=60, No-Store")
+		case "/no-cache":
+			w.Header().Set("Cache-Control", "no-cache")
+		case "/max-age":
+			w.Header().Set("Cache-Control", "public, max-age=0")
+		case "/expired":
+			w.Header().Set("Expires", "Thu, 01 Jan 1970 00:00:00 GMT")
+		case "/immutable":
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			w.Header().Set("Expires", "0")
+		case "/private":
+			w.Header().Set("Cache-Control", `private="x-user"`)
+		case "/vary":
+			w.Header().Set("Vary", "Accept-Encoding, Accept-Language")
+		case "/gzip":
+			w.Header().Set("Vary", "Accept-Encoding")
+		}
+		w.Write([]byte("hello " + r.Header.Get("Authorization") + r.Header.Get("Cookie")))
+	}))
+	defer origin.Close()
+
+	cache := NewDiskCache(LRUIndex(), DiskCacheOptions{
+		BasePath:       os.TempDir(),
+		BasePathPrefix: "cozy-transport-test",
+		DiskSizeMax:    1 << 20,
+	})
+	defer cache.PurgeAndClose()
+	_, err := NewTransport(cache, TransportOptions{})
+	assert.Equal(t, errTransportCacheable, err)
+	transport, err := NewTransport(cache, TransportOptions{
+		Cacheable: func(*http.Request) bool { return true },
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	client := &http.Client{Transport: transport}
+
+	get := func(path, header, value string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", origin.URL+path, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		res, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, res.Body.Close())
+		return res, string(b)
+	}
+
+	// the requests with credentials are not cached
+	for _, header := range []string{"Authorization", "Cookie"} {
+		for _, user := range []string{"alice", "bob"} {
+			_, body := get("/gzip", header, user)
+			assert.Equal(t, "hello "+user, body)
+		}
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+
+	// nor the responses specific to a user or to be revalidated
+	for _, path := range []string{"/cookie", "/no-store", "/private", "/vary", "/no-cache", "/max-age", "/expired"} {
+		atomic.StoreInt32(&requests, 0)
+		res, _ := get(path, "", "")
+		get(path, "", "")
+		assert.Equal(t, int32(2), atomic.LoadInt32(&requests), path)
+		if path == "/cookie" {
+			assert.Len(t, res.Cookies(), 1)
+		}
+	}
+
+	// the max-age directive overrides the Expires header
+	atomic.StoreInt32(&requests, 0)
+	get("/immutable", "", "")
+	get("/immutable", "", "")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// the encodings negotiated by the transport are decoded before caching,
+	// but not the ones requested explicitly
+	atomic.StoreInt32(&requests, 0)
+	for i := 0; i < 2; i++ {
+		_, body := get("/gzip", "", "")
+		assert.Equal(t, "hello ", body)
+		get("/gzip?explicit", "Accept-Encoding", "br")
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}